@@ -0,0 +1,177 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+var (
+	ErrBreakerOpen = errors.New("circuit breaker is open")
+)
+
+type CircuitBreakerConfig struct {
+	// consecutive dial failures to open the breaker, disabled when zero
+	FailureThreshold int
+
+	// time before a half-open probe is allowed, default is DefaultBreakerCooldown
+	Cooldown time.Duration
+}
+
+type BreakerState int
+
+const (
+	BreakerState_Closed BreakerState = iota
+	BreakerState_Open
+	BreakerState_HalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerState_Closed:
+		return "closed"
+	case BreakerState_Open:
+		return "open"
+	case BreakerState_HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker fails dials fast after consecutive failures, so requests
+// don't wait for dial timeout of a dead server. After cooldown a single
+// probe is let through, the breaker is closed if it succeeds.
+type CircuitBreaker struct {
+	Name   string
+	Config CircuitBreakerConfig
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(name string, cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultBreakerCooldown
+	}
+	return &CircuitBreaker{
+		Name:   name,
+		Config: cfg,
+	}
+}
+
+func (b *CircuitBreaker) enabled() bool {
+	return b.Config.FailureThreshold > 0
+}
+
+// Allow must be called before dialing, the result must be reported by
+// Report or Cancel if nil is returned.
+func (b *CircuitBreaker) Allow() error {
+	if !b.enabled() {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerState_Open:
+		if time.Since(b.openedAt) < b.Config.Cooldown {
+			return ErrBreakerOpen
+		}
+		b.setState(BreakerState_HalfOpen)
+		b.probing = true
+		return nil
+	case BreakerState_HalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Ready reports whether Allow may succeed, it does not change the state
+func (b *CircuitBreaker) Ready() bool {
+	if !b.enabled() {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerState_Open:
+		return time.Since(b.openedAt) >= b.Config.Cooldown
+	case BreakerState_HalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// Report reports the result of an allowed dial
+func (b *CircuitBreaker) Report(err error) {
+	if !b.enabled() {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.setState(BreakerState_Closed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerState_HalfOpen || b.failures >= b.Config.FailureThreshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerState_Open)
+	}
+}
+
+// Recover closes the breaker after a successful health check, so a
+// recovered server is used again before the cooldown ends
+func (b *CircuitBreaker) Recover() {
+	if !b.enabled() {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.setState(BreakerState_Closed)
+}
+
+// Cancel releases an allowed dial that is not relevant to the server health
+func (b *CircuitBreaker) Cancel() {
+	if !b.enabled() {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	l := logger.With("server", b.Name)
+	if state == BreakerState_Open {
+		l.Warnf("circuit breaker %s -> %s after %d failures", b.state, state, b.failures)
+	} else {
+		l.Infof("circuit breaker %s -> %s", b.state, state)
+	}
+	b.state = state
+}
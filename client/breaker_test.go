@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := NewCircuitBreaker("test", CircuitBreakerConfig{FailureThreshold: 2, Cooldown: 20 * time.Millisecond})
+	errDial := errors.New("refused")
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("closed breaker rejected dial: %v", err)
+		}
+		b.Report(errDial)
+	}
+	if s := b.State(); s != BreakerState_Open {
+		t.Fatalf("expect open after 2 failures, got %s", s)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrBreakerOpen) || b.Ready() {
+		t.Fatalf("open breaker let dial through: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.Ready() {
+		t.Fatal("expect ready after cooldown")
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expect a probe allowed after cooldown, got %v", err)
+	}
+	if s := b.State(); s != BreakerState_HalfOpen {
+		t.Fatalf("expect half-open, got %s", s)
+	}
+	// only one probe at a time
+	if err := b.Allow(); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expect second probe rejected, got %v", err)
+	}
+
+	// a failed probe opens it again
+	b.Report(errDial)
+	if s := b.State(); s != BreakerState_Open {
+		t.Fatalf("expect open after failed probe, got %s", s)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Report(nil)
+	if s := b.State(); s != BreakerState_Closed {
+		t.Fatalf("expect closed after successful probe, got %s", s)
+	}
+	// failures are counted from zero again
+	b.Allow()
+	b.Report(errDial)
+	if s := b.State(); s != BreakerState_Closed {
+		t.Fatalf("expect closed after 1 failure, got %s", s)
+	}
+}
+
+func TestCircuitBreakerCancel(t *testing.T) {
+	b := NewCircuitBreaker("test", CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Millisecond})
+	b.Allow()
+	b.Report(errors.New("refused"))
+	time.Sleep(5 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	// a canceled probe lets the next one through
+	b.Cancel()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expect probe allowed after cancel, got %v", err)
+	}
+}
+
+func TestCircuitBreakerRecoverByHealthCheck(t *testing.T) {
+	fc := newTestForwardClient("a")
+	fc.breaker = NewCircuitBreaker("a", CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Hour})
+	fc.breaker.Allow()
+	fc.breaker.Report(errors.New("refused"))
+	if fc.Available() {
+		t.Fatal("expect unavailable with an open breaker")
+	}
+
+	// failed probes leave the breaker open
+	probeErr := errors.New("timeout")
+	probe := fc.recoverBreaker(func(ctx context.Context) error { return probeErr })
+	probe(context.Background())
+	if s := fc.BreakerState(); s != BreakerState_Open {
+		t.Fatalf("expect open after failed probe, got %s", s)
+	}
+	probeErr = nil
+	probe(context.Background())
+	if s := fc.BreakerState(); s != BreakerState_Closed {
+		t.Fatalf("expect closed after successful probe, got %s", s)
+	}
+	if err := fc.breaker.Allow(); err != nil {
+		t.Errorf("expect dial allowed before cooldown, got %v", err)
+	}
+}
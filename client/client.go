@@ -2,9 +2,14 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/mengseeker/nlink/core/geoip"
+	"github.com/mengseeker/nlink/core/resolver"
 )
 
 type ServerConfig struct {
@@ -16,6 +21,11 @@ type ServerConfig struct {
 	MaxConns    int
 	IdleTimeout time.Duration
 	MaxIdle     int
+	MinIdle     int
+	WaitTimeout time.Duration
+
+	HealthCheck    HealthCheckConfig
+	CircuitBreaker CircuitBreakerConfig
 }
 
 type ResolverConfig struct {
@@ -28,13 +38,55 @@ type ProxyConfig struct {
 	Net      string
 	Cert     string
 	Key      string
-	Rules    []string
 	Servers  []ServerConfig
 	Resolver []ResolverConfig
 	Groups   []ForwardGroupConfig
+
+	// string rules or structured rules, see UnmashalRuleConfig
+	Rules     []any
+	RuleCache RuleCacheConfig
+
+	// order of resolved addresses: ipv4, ipv6, ipv4-only or ipv6-only, default is ipv4
+	IPPreference resolver.IPPreference
+
+	// rule sets loaded from files, used by rule-set condition
+	RuleProviders []RuleProviderConfig
+	// v2ray geosite.dat used by geosite condition, the embedded one is used if
+	// empty, which is only available in builds of "make build-geosite"
+	GeoSite string
+	GeoIP   geoip.Config
+
+	// controller api listen address, disabled if empty
+	Controller string
+	// requests to the controller must carry "Authorization: Bearer <secret>",
+	// may be empty only if the controller listens on a loopback address
+	ControllerSecret string
+	// file saving the members of select groups, default is DefaultStateFile
+	StateFile string
 }
 
 func Start(cfg ProxyConfig) error {
+	c, err := NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	return c.ListenAndServe()
+}
+
+// Client is a running proxy client, it can be closed and created again
+// with a new config.
+type Client struct {
+	Config ProxyConfig
+
+	provider   *FuncProvider
+	mapper     *RuleMapper
+	servers    map[string]*ForwardClient
+	groups     map[string]*ForwardGroup
+	listener   *Listener
+	controller *Controller
+}
+
+func NewClient(cfg ProxyConfig) (_ *Client, err error) {
 	if cfg.Listen == "" {
 		cfg.Listen = ":7890"
 	}
@@ -51,48 +103,116 @@ func Start(cfg ProxyConfig) error {
 	fmt.Printf("start proxy with config:\n")
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "  ")
-	encoder.Encode(cfg)
+	printed := cfg
+	if printed.ControllerSecret != "" {
+		printed.ControllerSecret = "******"
+	}
+	encoder.Encode(printed)
+
+	c := &Client{
+		Config:  cfg,
+		servers: map[string]*ForwardClient{},
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
 
-	provider, err := NewFuncProvider(cfg.Resolver, cfg.Servers)
+	c.provider, err = NewFuncProvider(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	forwards := map[string]Forward{}
-	forwardClients := map[string]*ForwardClient{}
 	for _, sc := range cfg.Servers {
 		forward, err := NewForwardClient(sc)
 		if err != nil {
-			return fmt.Errorf("new forwardclient %s err: %v", sc.Name, err)
+			return nil, fmt.Errorf("new forwardclient %s err: %v", sc.Name, err)
 		}
 		forwards[sc.Name] = forward
-		forwardClients[sc.Name] = forward
+		c.servers[sc.Name] = forward
 	}
 
-	for _, gc := range cfg.Groups {
-		if _, ok := forwards[gc.Name]; ok {
-			return fmt.Errorf("group name conflict with server name: %s", gc.Name)
-		}
-		g, err := NewForwardGroup(forwardClients, gc)
-		if err != nil {
-			return fmt.Errorf("new group %s err: %v", gc.Name, err)
-		}
-		forwards[gc.Name] = g
+	store, err := LoadSelectStore(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	c.groups, err = NewForwardGroups(c.servers, cfg.Groups, store)
+	if err != nil {
+		return nil, err
+	}
+	for name, g := range c.groups {
+		forwards[name] = g
 	}
 
-	mapper, err := NewRuleMapper(cfg.Rules, provider, forwards)
+	c.mapper, err = NewRuleMapper(cfg.Rules, cfg.RuleCache, c.provider, forwards)
 	if err != nil {
-		return fmt.Errorf("parse rule err: %v", err)
+		return nil, fmt.Errorf("parse rule err: %v", err)
 	}
-	httpHandler := NewHTTPHandler(mapper)
-	socks4Handler := NewSocks4Handler(mapper)
-	socks5Handler := NewSocks5Handler(mapper)
+	httpHandler := NewHTTPHandler(c.mapper)
+	socks4Handler := NewSocks4Handler(c.mapper)
+	socks5Handler := NewSocks5Handler(c.mapper)
 
-	lis := &Listener{
+	if cfg.Controller != "" {
+		c.controller, err = NewController(cfg.Controller, cfg.ControllerSecret, c.servers, c.groups, c.mapper)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.listener = &Listener{
 		Address:       cfg.Listen,
 		HTTPHandler:   httpHandler,
 		Socks4Handler: socks4Handler,
 		Socks5Handler: socks5Handler,
 	}
-	return lis.ListenAndServe()
+	return c, nil
+}
+
+// ListenAndServe serves until the client is closed
+func (c *Client) ListenAndServe() error {
+	if c.controller != nil {
+		go func() {
+			if err := c.controller.ListenAndServe(); err != nil {
+				logger.Errorf("controller exit: %v", err)
+			}
+		}()
+	}
+	return c.listener.ListenAndServe()
+}
+
+// Close stops listening and closes all groups and servers
+func (c *Client) Close() error {
+	var errs []error
+	if c.listener != nil {
+		errs = append(errs, c.listener.Close())
+	}
+	if c.controller != nil {
+		errs = append(errs, c.controller.Close())
+	}
+	if c.mapper != nil {
+		errs = append(errs, c.mapper.Close())
+	}
+	if c.provider != nil {
+		errs = append(errs, c.provider.Close())
+	}
+	for _, g := range c.groups {
+		errs = append(errs, g.Close())
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, fc := range c.servers {
+		wg.Add(1)
+		go func(fc *ForwardClient) {
+			defer wg.Done()
+			if err := fc.Close(); err != nil {
+				lock.Lock()
+				errs = append(errs, fmt.Errorf("close server %s err: %v", fc.Name(), err))
+				lock.Unlock()
+			}
+		}(fc)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed key pair to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestClientCloseStopsPools(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCert(t, dir)
+	before := runtime.NumGoroutine()
+
+	c, err := NewClient(ProxyConfig{
+		Listen:    "127.0.0.1:0",
+		Cert:      cert,
+		Key:       key,
+		StateFile: filepath.Join(dir, "state.json"),
+		Servers: []ServerConfig{
+			// nothing listens on port 1, MinIdle keeps the fill goroutine busy
+			{Name: "a", Addr: "127.0.0.1:1", MaxIdle: 1, MinIdle: 1},
+			{Name: "b", Addr: "127.0.0.1:1"},
+		},
+		Groups: []ForwardGroupConfig{{Name: "g", Servers: []string{"a", "b"}, Selecter: SelecterConfig{Type: SelecterType_RoundRobin}}},
+		Rules:  []any{"match-all, forward: g"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Fatal("expect pool goroutines started")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fc := range c.servers {
+		if fc.pool.ctx.Err() == nil {
+			t.Errorf("pool of %s not closed", fc.Name())
+		}
+	}
+	if c.groups["g"].Available() {
+		t.Error("closed group is available")
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// blockHandler holds the conn until the peer closes it
+type blockHandler struct{}
+
+func (blockHandler) HandleConn(conn net.Conn) {
+	io.Copy(io.Discard, conn)
+	conn.Close()
+}
+
+func TestListenerCloseTimeout(t *testing.T) {
+	l := &Listener{Address: "127.0.0.1:0", Socks5Handler: blockHandler{}, CloseTimeout: 50 * time.Millisecond}
+	served := make(chan error, 1)
+	go func() { served <- l.ListenAndServe() }()
+	waitFor(t, func() bool {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return l.lis != nil
+	})
+
+	conn, err := net.Dial("tcp", l.lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5})
+	waitFor(t, func() bool {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return len(l.conns) == 1
+	})
+
+	start := time.Now()
+	err = l.Close()
+	if err == nil || !strings.Contains(err.Error(), "1 connections closed") {
+		t.Errorf("expect the active conn closed by timeout, got %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("close did not wait for the active conn, took %s", d)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect conn closed by listener, got %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe returned %v", err)
+	}
+}
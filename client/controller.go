@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Controller serves the http api to inspect and control a running client
+type Controller struct {
+	Address string
+	// bearer token of requests, not checked if empty
+	Secret string
+
+	servers map[string]*ForwardClient
+	groups  map[string]*ForwardGroup
+	mapper  *RuleMapper
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+type ServerInfo struct {
+	Name    string
+	Addr    string
+	Health  string
+	Latency time.Duration
+	Breaker string
+	Pool    PoolStats
+}
+
+type GroupInfo struct {
+	Name     string
+	Type     SelecterType
+	Members  []string
+	Selected string `json:",omitempty"`
+}
+
+type RulesInfo struct {
+	Cache RuleCacheStats
+	Rules []RuleStats
+}
+
+type SelectRequest struct {
+	Name string
+}
+
+// NewController returns an error if secret is empty and address is not a
+// loopback address, anyone reaching it could switch the selected servers.
+func NewController(address, secret string, servers map[string]*ForwardClient, groups map[string]*ForwardGroup, mapper *RuleMapper) (*Controller, error) {
+	if secret == "" && !isLoopbackAddress(address) {
+		return nil, fmt.Errorf("controller secret is required to listen on %s, not a loopback address", address)
+	}
+	c := &Controller{
+		Address: address,
+		Secret:  secret,
+		servers: servers,
+		groups:  groups,
+		mapper:  mapper,
+		mux:     http.NewServeMux(),
+	}
+	c.server = &http.Server{Addr: address, Handler: c}
+	c.mux.HandleFunc("/servers", c.handleServers)
+	c.mux.HandleFunc("/groups", c.handleGroups)
+	c.mux.HandleFunc("/groups/", c.handleGroup)
+	c.mux.HandleFunc("/rules", c.handleRules)
+	return c, nil
+}
+
+// isLoopbackAddress reports whether host of address is localhost or a
+// loopback ip, an empty host listens on all interfaces
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *Controller) ListenAndServe() error {
+	logger.Infof("controller listen on %s", c.Address)
+	if c.Secret == "" {
+		logger.Warnf("controller secret is not set, the api is only protected by listening on loopback")
+	}
+	err := c.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Controller) Close() error {
+	return c.server.Close()
+}
+
+// ServeHTTP checks the secret and dispatches the request
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.Secret != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.Secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+// GET /servers
+func (c *Controller) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos := []ServerInfo{}
+	for _, fc := range c.servers {
+		infos = append(infos, ServerInfo{
+			Name:    fc.Name(),
+			Addr:    fc.Config.Addr,
+			Health:  fc.HealthState().String(),
+			Latency: fc.Latency(),
+			Breaker: fc.BreakerState().String(),
+			Pool:    fc.PoolStats(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	writeJSON(w, infos)
+}
+
+func groupInfo(g *ForwardGroup) GroupInfo {
+	info := GroupInfo{
+		Name:     g.Name(),
+		Type:     g.cfg.Selecter.Type,
+		Selected: g.Selected(),
+	}
+	for _, m := range g.Members() {
+		info.Members = append(info.Members, m.Name())
+	}
+	return info
+}
+
+// GET /groups
+func (c *Controller) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos := []GroupInfo{}
+	for _, g := range c.groups {
+		infos = append(infos, groupInfo(g))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	writeJSON(w, infos)
+}
+
+// GET /groups/{name}
+// PUT /groups/{name} {"Name": "member"}
+func (c *Controller) handleGroup(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/groups/")
+	g := c.groups[name]
+	if g == nil {
+		http.Error(w, "group not found: "+name, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req SelectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := g.Select(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, groupInfo(g))
+}
+
+// GET /rules
+func (c *Controller) handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, RulesInfo{
+		Cache: c.mapper.CacheStats(),
+		Rules: c.mapper.Stats(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// ControllerClient calls the controller api of a running client
+type ControllerClient struct {
+	// base url, e.g. http://127.0.0.1:9090
+	URL string
+	// secret of the controller, empty if not set
+	Secret string
+}
+
+func NewControllerClient(address, secret string) *ControllerClient {
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	}
+	return &ControllerClient{URL: "http://" + address, Secret: secret}
+}
+
+func (c *ControllerClient) do(method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, c.URL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if c.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("controller response %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *ControllerClient) Servers() (infos []ServerInfo, err error) {
+	err = c.do(http.MethodGet, "/servers", nil, &infos)
+	return
+}
+
+func (c *ControllerClient) Rules() (info RulesInfo, err error) {
+	err = c.do(http.MethodGet, "/rules", nil, &info)
+	return
+}
+
+func (c *ControllerClient) Groups() (infos []GroupInfo, err error) {
+	err = c.do(http.MethodGet, "/groups", nil, &infos)
+	return
+}
+
+func (c *ControllerClient) Group(name string) (info GroupInfo, err error) {
+	err = c.do(http.MethodGet, "/groups/"+name, nil, &info)
+	return
+}
+
+func (c *ControllerClient) Select(group, member string) (info GroupInfo, err error) {
+	if group == "" || member == "" {
+		return info, errors.New("group and member must not empty")
+	}
+	err = c.do(http.MethodPut, "/groups/"+group, SelectRequest{Name: member}, &info)
+	return
+}
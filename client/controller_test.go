@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func newTestController(t *testing.T, secret string) (*ControllerClient, *ForwardGroup) {
+	a, b := newTestForwardClient("a"), newTestForwardClient("b")
+	store, err := LoadSelectStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewForwardGroup(map[string]Forward{"a": a, "b": b}, ForwardGroupConfig{
+		Name:     "proxy",
+		Servers:  []string{"a", "b"},
+		Selecter: SelecterConfig{Type: SelecterType_Select},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := NewController("127.0.0.1:0", secret, map[string]*ForwardClient{"a": a, "b": b}, map[string]*ForwardGroup{"proxy": g}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ctl)
+	t.Cleanup(srv.Close)
+	return &ControllerClient{URL: srv.URL, Secret: secret}, g
+}
+
+func TestControllerSelect(t *testing.T) {
+	ctl, g := newTestController(t, "")
+	info, err := ctl.Group("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Selected != "a" || len(info.Members) != 2 {
+		t.Errorf("unexpected group info %+v", info)
+	}
+	if info, err = ctl.Select("proxy", "b"); err != nil || info.Selected != "b" {
+		t.Fatalf("select b got %+v, err %v", info, err)
+	}
+	if g.Selected() != "b" {
+		t.Errorf("group selected %s, want b", g.Selected())
+	}
+	if _, err := ctl.Select("proxy", "c"); err == nil {
+		t.Error("expect error selecting unknown member")
+	}
+	if _, err := ctl.Group("unknown"); err == nil {
+		t.Error("expect error of unknown group")
+	}
+}
+
+func TestControllerSecret(t *testing.T) {
+	ctl, g := newTestController(t, "s3cret")
+	if _, err := ctl.Groups(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"", "wrong"} {
+		bad := &ControllerClient{URL: ctl.URL, Secret: secret}
+		if _, err := bad.Select("proxy", "b"); err == nil {
+			t.Errorf("secret %q: expect unauthorized", secret)
+		}
+	}
+	if g.Selected() != "a" {
+		t.Error("unauthorized request changed the selection")
+	}
+
+	resp, err := http.Get(ctl.URL + "/servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expect 401, got %s", resp.Status)
+	}
+
+	// an empty secret is allowed only on loopback
+	for address, ok := range map[string]bool{
+		"127.0.0.1:9090":   true,
+		"[::1]:9090":       true,
+		"localhost:9090":   true,
+		":9090":            false,
+		"0.0.0.0:9090":     false,
+		"192.168.1.1:9090": false,
+	} {
+		_, err := NewController(address, "", nil, nil, nil)
+		if (err == nil) != ok {
+			t.Errorf("address %s: got err %v", address, err)
+		}
+	}
+	if _, err := NewController(":9090", "s3cret", nil, nil, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestControllerServers(t *testing.T) {
+	fc := newTestForwardClient("tokyo")
+	fc.Config.Addr = "tokyo.example.com:8899"
+	fc.pool = newTestPool(ServerConfig{MaxConns: 2})
+	defer fc.pool.Close()
+	conn, err := fc.pool.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.pool.Put(conn)
+
+	ctl, err := NewController("localhost:0", "", map[string]*ForwardClient{"tokyo": fc}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ctl)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var infos []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expect 1 server, got %v", infos)
+	}
+	info := infos[0]
+	for _, key := range []string{"Name", "Addr", "Health", "Latency", "Breaker", "Pool"} {
+		if _, ok := info[key]; !ok {
+			t.Errorf("missing key %s in %v", key, info)
+		}
+	}
+	if info["Name"] != "tokyo" || info["Health"] != "unknown" || info["Breaker"] != "closed" {
+		t.Errorf("unexpected server info %v", info)
+	}
+	pool, _ := info["Pool"].(map[string]any)
+	for key, want := range map[string]float64{"Dials": 1, "DialRemotes": 1, "Active": 1, "Idle": 0} {
+		if pool[key] != want {
+			t.Errorf("pool %s = %v, want %v", key, pool[key], want)
+		}
+	}
+}
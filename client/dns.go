@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// max time of dialing directly if the context has no deadline
+	DefaultDirectDialTimeout = 30 * time.Second
+)
+
+// ttl of failed lookups, not longer than the ttl of the cache, so a domain
+// without addresses is not resolved on every request
+const dnsNegativeTTL = 5 * time.Second
+
+// min time of dialing each resolved address, the remaining time is split
+// among the addresses not tried yet like net.Dialer does
+var minDialAttemptTimeout = 2 * time.Second
+
+type dnsEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// dnsCall is an in-flight lookup shared by concurrent callers
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+}
+
+// dnsCache caches resolved addresses of domains, concurrent lookups of the
+// same domain are merged into one. Failed lookups are cached for
+// dnsNegativeTTL.
+type dnsCache struct {
+	// max entries, negative to disable caching
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[string]dnsEntry
+	calls   map[string]*dnsCall
+}
+
+func newDNSCache(size int, ttl time.Duration) *dnsCache {
+	if size == 0 {
+		size = DefaultRuleCacheSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultRuleCacheDNSTTL
+	}
+	return &dnsCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]dnsEntry{},
+		calls:   map[string]*dnsCall{},
+	}
+}
+
+// Get returns the cached addresses of domain, empty if the cached lookup
+// failed
+func (c *dnsCache) Get(domain string) ([]net.IP, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.get(domain)
+}
+
+func (c *dnsCache) get(domain string) ([]net.IP, bool) {
+	e, ok := c.entries[domain]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expire) {
+		delete(c.entries, domain)
+		return nil, false
+	}
+	return e.ips, true
+}
+
+// Lookup returns the cached addresses of domain, or calls lookup and caches
+// the result. Callers of the same domain wait for the running lookup.
+func (c *dnsCache) Lookup(domain string, lookup func(domain string) []net.IP) []net.IP {
+	c.lock.Lock()
+	if ips, ok := c.get(domain); ok {
+		c.lock.Unlock()
+		return ips
+	}
+	if call, ok := c.calls[domain]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.ips
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	c.calls[domain] = call
+	c.lock.Unlock()
+
+	// waiters are released even if lookup panics, nothing is cached then
+	completed := false
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, domain)
+		if completed {
+			ttl := c.ttl
+			if len(call.ips) == 0 && ttl > dnsNegativeTTL {
+				ttl = dnsNegativeTTL
+			}
+			c.put(domain, call.ips, ttl)
+		}
+		c.lock.Unlock()
+		close(call.done)
+	}()
+	call.ips = lookup(domain)
+	completed = true
+	return call.ips
+}
+
+func (c *dnsCache) put(domain string, ips []net.IP, ttl time.Duration) {
+	if c.size < 0 {
+		return
+	}
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for d, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, d)
+			}
+		}
+		// still full, drop random entries
+		for d := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, d)
+		}
+	}
+	c.entries[domain] = dnsEntry{ips: ips, expire: time.Now().Add(ttl)}
+}
+
+// DialContext dials address with the addresses resolved while matching
+// rules, in the order of the ip preference. Falls back to the system
+// resolver if the host was not resolved.
+func (pv *FuncProvider) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultDirectDialTimeout)
+		defer cancel()
+	}
+	if pv == nil {
+		return d.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, address)
+	}
+	ips, ok := pv.dns.Get(normalizeDomain(host))
+	if !ok || len(ips) == 0 {
+		return d.DialContext(ctx, network, address)
+	}
+	var errs []error
+	for i, ip := range ips {
+		// an unreachable address must not use up the time of the others
+		attemptCtx, cancel := context.WithTimeout(ctx, dialAttemptTimeout(ctx, len(ips)-i))
+		conn, err := d.DialContext(attemptCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialAttemptTimeout returns the time of dialing the next one of remaining
+// addresses before the deadline of ctx
+func dialAttemptTimeout(ctx context.Context, remaining int) time.Duration {
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline) / time.Duration(remaining)
+	if timeout < minDialAttemptTimeout {
+		timeout = minDialAttemptTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheLookup(t *testing.T) {
+	c := newDNSCache(0, time.Minute)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	lookup := func(domain string) []net.IP {
+		calls.Add(1)
+		<-release
+		return []net.IP{net.ParseIP("1.2.3.4")}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips := c.Lookup("a.com", lookup); len(ips) != 1 {
+				t.Errorf("expect 1 ip, got %v", ips)
+			}
+		}()
+	}
+	// let the callers wait for the first lookup
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expect 1 lookup, got %d", n)
+	}
+	if _, ok := c.Get("a.com"); !ok {
+		t.Error("expect a.com cached")
+	}
+
+	// failed lookups are cached for a short time
+	c.Lookup("b.com", func(string) []net.IP { return nil })
+	if ips, ok := c.Get("b.com"); !ok || len(ips) != 0 {
+		t.Errorf("expect b.com cached as failed, got %v", ips)
+	}
+	c.Lookup("b.com", func(string) []net.IP {
+		t.Error("failed lookup resolved again")
+		return nil
+	})
+	if e := c.entries["b.com"]; time.Until(e.expire) > dnsNegativeTTL {
+		t.Errorf("failed lookup cached until %v", e.expire)
+	}
+}
+
+func TestDNSCacheLookupPanic(t *testing.T) {
+	c := newDNSCache(0, time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.Lookup("a.com", func(string) []net.IP {
+			close(started)
+			<-release
+			panic("lookup")
+		})
+	}()
+	<-started
+	waited := make(chan []net.IP)
+	go func() {
+		waited <- c.Lookup("a.com", func(string) []net.IP { return []net.IP{net.ParseIP("1.2.3.4")} })
+	}()
+	// let the second caller wait for the first lookup
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after lookup panicked")
+	}
+	if _, ok := c.Get("a.com"); ok {
+		t.Error("expect nothing cached after panic")
+	}
+	if ips := c.Lookup("a.com", func(string) []net.IP { return []net.IP{net.ParseIP("1.2.3.4")} }); len(ips) != 1 {
+		t.Errorf("expect resolved again, got %v", ips)
+	}
+}
+
+func TestDialContextUnreachableAddress(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	old := minDialAttemptTimeout
+	minDialAttemptTimeout = 50 * time.Millisecond
+	defer func() { minDialAttemptTimeout = old }()
+
+	pv := &FuncProvider{dns: newDNSCache(0, 0)}
+	// a blackhole address before the working one
+	pv.dns.Lookup("a.test", func(string) []net.IP {
+		return []net.IP{net.ParseIP("10.255.255.1"), net.ParseIP("127.0.0.1")}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := pv.DialContext(ctx, "tcp", net.JoinHostPort("a.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// the first attempt has half of the time
+	if d := time.Since(start); d > 800*time.Millisecond {
+		t.Errorf("dial took %v", d)
+	}
+
+	if d := dialAttemptTimeout(ctx, 2); d > 500*time.Millisecond || d < 300*time.Millisecond {
+		t.Errorf("expect half of the remaining time, got %v", d)
+	}
+	if d := dialAttemptTimeout(ctx, 100); d != minDialAttemptTimeout {
+		t.Errorf("expect min attempt timeout, got %v", d)
+	}
+}
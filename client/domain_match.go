@@ -0,0 +1,364 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mengseeker/nlink/core/geosite"
+)
+
+// normalizeDomain lowercases host and trims the trailing dot
+func normalizeDomain(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// MatchDomainSuffix reports whether host is suffix or a subdomain of it,
+// a leading dot of suffix is ignored, so ".cn" and "cn" both match "a.cn"
+// but not "notcn".
+func MatchDomainSuffix(host, suffix string) bool {
+	host = normalizeDomain(host)
+	suffix = normalizeDomain(strings.TrimPrefix(suffix, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return false
+	}
+	return len(host) == len(suffix) || host[len(host)-len(suffix)-1] == '.'
+}
+
+type domainTrieNode struct {
+	children map[string]*domainTrieNode
+	// min rule index ending at this node, -1 if none
+	index int
+}
+
+// domainTrie is a trie of reversed domain labels, "www.example.com" is
+// stored as com -> example -> www.
+type domainTrie struct {
+	root *domainTrieNode
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &domainTrieNode{index: -1}}
+}
+
+func (t *domainTrie) Insert(suffix string, index int) {
+	suffix = normalizeDomain(strings.TrimPrefix(suffix, "."))
+	n := t.root
+	for suffix != "" {
+		var label string
+		if i := strings.LastIndexByte(suffix, '.'); i >= 0 {
+			label, suffix = suffix[i+1:], suffix[:i]
+		} else {
+			label, suffix = suffix, ""
+		}
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = map[string]*domainTrieNode{}
+			}
+			child = &domainTrieNode{index: -1}
+			n.children[label] = child
+		}
+		n = child
+	}
+	if n.index < 0 || index < n.index {
+		n.index = index
+	}
+}
+
+// Match returns the min index of suffixes matching host, -1 if none
+func (t *domainTrie) Match(host string) int {
+	host = normalizeDomain(host)
+	n := t.root
+	min := -1
+	for host != "" {
+		var label string
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			label, host = host[i+1:], host[:i]
+		} else {
+			label, host = host, ""
+		}
+		n = n.children[label]
+		if n == nil {
+			break
+		}
+		if n.index >= 0 && (min < 0 || n.index < min) {
+			min = n.index
+		}
+	}
+	return min
+}
+
+type keywordNode struct {
+	next map[byte]int
+	fail int
+	// min rule index of keywords ending here, including the fail chain
+	index int
+}
+
+// keywordMatcher is an Aho-Corasick automaton finding keywords in host
+type keywordMatcher struct {
+	nodes []keywordNode
+}
+
+func newKeywordMatcher() *keywordMatcher {
+	return &keywordMatcher{nodes: []keywordNode{{index: -1}}}
+}
+
+func (m *keywordMatcher) Insert(keyword string, index int) {
+	n := 0
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+		next, ok := m.nodes[n].next[c]
+		if !ok {
+			if m.nodes[n].next == nil {
+				m.nodes[n].next = map[byte]int{}
+			}
+			m.nodes = append(m.nodes, keywordNode{index: -1})
+			next = len(m.nodes) - 1
+			m.nodes[n].next[c] = next
+		}
+		n = next
+	}
+	if m.nodes[n].index < 0 || index < m.nodes[n].index {
+		m.nodes[n].index = index
+	}
+}
+
+// Build computes fail links, must be called after all keywords are inserted
+func (m *keywordMatcher) Build() {
+	queue := []int{}
+	for _, child := range m.nodes[0].next {
+		m.nodes[child].fail = 0
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for {
+				if next, ok := m.nodes[f].next[c]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					m.nodes[child].fail = 0
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			// fail node is closer to root, it is already merged
+			if fi := m.nodes[m.nodes[child].fail].index; fi >= 0 && (m.nodes[child].index < 0 || fi < m.nodes[child].index) {
+				m.nodes[child].index = fi
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+// Match returns the min index of keywords contained in s, -1 if none
+func (m *keywordMatcher) Match(s string) int {
+	n, min := 0, -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for {
+			if next, ok := m.nodes[n].next[c]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		if idx := m.nodes[n].index; idx >= 0 && (min < 0 || idx < min) {
+			min = idx
+			if min == 0 {
+				return 0
+			}
+		}
+	}
+	return min
+}
+
+// domainRuleBlock matches a run of consecutive rules, each of them has only
+// one host-suffix, host-match or geosite condition. Returns the first
+// matched rule.
+type domainRuleBlock struct {
+	suffixes *domainTrie
+	keywords *keywordMatcher
+	sites    *domainMatcher
+}
+
+func (b *domainRuleBlock) Match(host string) int {
+	idx := b.suffixes.Match(host)
+	if k := b.keywords.Match(host); k >= 0 && (idx < 0 || k < idx) {
+		idx = k
+	}
+	if k := b.sites.Index(host); k >= 0 && (idx < 0 || k < idx) {
+		idx = k
+	}
+	return idx
+}
+
+// isDomainRule reports whether r can be compiled into a domainRuleBlock
+func isDomainRule(r Rule) bool {
+	if r.Expr.Op != RuleExprOp_Cond {
+		return false
+	}
+	switch r.Expr.Cond.Cond {
+	case RuleCondType_HostSuffix, RuleCondType_HostMatch, RuleCondType_GeoSite:
+		return true
+	}
+	return false
+}
+
+// compileRules returns the steps of matching rules at indexes, each step
+// returns the index of matched rule or -1. Consecutive domain rules are
+// merged into one step, the other rules are evaluated one by one, so the
+// first matched rule wins.
+func compileRules(pv *FuncProvider, rules []Rule, matchs []func(MatchMeta) bool, indexes []int) []func(MatchMeta) int {
+	steps := []func(MatchMeta) int{}
+	for i := 0; i < len(indexes); {
+		j := i
+		for j < len(indexes) && isDomainRule(rules[indexes[j]]) {
+			j++
+		}
+		// a single domain rule is cheap enough
+		if j-i > 1 {
+			block := &domainRuleBlock{
+				suffixes: newDomainTrie(),
+				keywords: newKeywordMatcher(),
+				sites:    newDomainMatcher(),
+			}
+			for _, k := range indexes[i:j] {
+				c := rules[k].Expr.Cond
+				switch c.Cond {
+				case RuleCondType_HostSuffix:
+					block.suffixes.Insert(c.CondParam, k)
+				case RuleCondType_HostMatch:
+					block.keywords.Insert(c.CondParam, k)
+				case RuleCondType_GeoSite:
+					// checked by RuleCond.Check, never matches if not found
+					if site, err := pv.geoSiteCategory(c.CondParam); err == nil {
+						block.sites.Add(site, k)
+					}
+				}
+			}
+			block.keywords.Build()
+			block.sites.Build()
+			steps = append(steps, func(mm MatchMeta) int {
+				return block.Match(mm.Host)
+			})
+			i = j
+			continue
+		}
+		idx, match := indexes[i], matchs[indexes[i]]
+		steps = append(steps, func(mm MatchMeta) int {
+			if match(mm) {
+				return idx
+			}
+			return -1
+		})
+		i++
+	}
+	return steps
+}
+
+// geositeCategory is a compiled category of geosite
+type geositeCategory struct {
+	// domains except regexps
+	domains []geosite.Domain
+	regexps []*regexp.Regexp
+}
+
+func newGeoSiteCategory(domains []geosite.Domain) (*geositeCategory, error) {
+	c := &geositeCategory{}
+	for _, d := range domains {
+		if d.Type != geosite.DomainType_Regex {
+			c.domains = append(c.domains, d)
+			continue
+		}
+		// hosts are lowercased, the value keeps its case
+		reg, err := regexp.Compile("(?i)" + d.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain regexp %q: %v", d.Value, err)
+		}
+		c.regexps = append(c.regexps, reg)
+	}
+	return c, nil
+}
+
+type indexedRegexp struct {
+	reg   *regexp.Regexp
+	index int
+}
+
+// domainMatcher matches host against geosite categories, each of them is
+// added with the index of its rule
+type domainMatcher struct {
+	full     map[string]int
+	suffixes *domainTrie
+	keywords *keywordMatcher
+	// in the order of index
+	regexps []indexedRegexp
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{
+		full:     map[string]int{},
+		suffixes: newDomainTrie(),
+		keywords: newKeywordMatcher(),
+	}
+}
+
+// Add adds the domains of c with index, categories must be added in the order
+// of index
+func (m *domainMatcher) Add(c *geositeCategory, index int) {
+	for _, d := range c.domains {
+		switch d.Type {
+		case geosite.DomainType_Full:
+			if _, ok := m.full[normalizeDomain(d.Value)]; !ok {
+				m.full[normalizeDomain(d.Value)] = index
+			}
+		case geosite.DomainType_Domain:
+			m.suffixes.Insert(d.Value, index)
+		case geosite.DomainType_Plain:
+			m.keywords.Insert(d.Value, index)
+		}
+	}
+	for _, reg := range c.regexps {
+		m.regexps = append(m.regexps, indexedRegexp{reg: reg, index: index})
+	}
+}
+
+// Build must be called after all categories are added
+func (m *domainMatcher) Build() {
+	m.keywords.Build()
+}
+
+// Index returns the min index of categories matching host, -1 if none
+func (m *domainMatcher) Index(host string) int {
+	host = normalizeDomain(host)
+	idx := m.suffixes.Match(host)
+	if k := m.keywords.Match(host); k >= 0 && (idx < 0 || k < idx) {
+		idx = k
+	}
+	if k, ok := m.full[host]; ok && (idx < 0 || k < idx) {
+		idx = k
+	}
+	for _, r := range m.regexps {
+		if idx >= 0 && r.index >= idx {
+			break
+		}
+		if r.reg.MatchString(host) {
+			return r.index
+		}
+	}
+	return idx
+}
+
+func (m *domainMatcher) Match(host string) bool {
+	return m.Index(host) >= 0
+}
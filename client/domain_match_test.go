@@ -0,0 +1,200 @@
+package client
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mengseeker/nlink/core/geosite"
+)
+
+func TestMatchDomainSuffix(t *testing.T) {
+	cases := []struct {
+		host, suffix string
+		want         bool
+	}{
+		{"a.cn", ".cn", true},
+		{"notcn", ".cn", false},
+		{"notcn", "cn", false},
+		{"google.com", "google.com", true},
+		{"www.Google.com.", "google.com", true},
+		{"notgoogle.com", "google.com", false},
+	}
+	for _, c := range cases {
+		if got := MatchDomainSuffix(c.host, c.suffix); got != c.want {
+			t.Errorf("MatchDomainSuffix(%q, %q) = %v, want %v", c.host, c.suffix, got, c.want)
+		}
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	raws := []string{
+		"host-suffix: ad.com, reject",
+		"host-match: cdn, direct",
+		"host-suffix: .cn, direct",
+		"host-match: ogle, reject",
+		"host-suffix: google.com, direct",
+		"match-all && host-match: x, reject",
+		"host-match: he, direct",
+		"host-match: she, reject",
+		"host-suffix: com, direct",
+	}
+	var rules []Rule
+	var matchs []func(MatchMeta) bool
+	var indexes []int
+	for i, raw := range raws {
+		r, err := UnmashalProxyRule(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+		matchs = append(matchs, r.NewMatchFunc(nil))
+		indexes = append(indexes, i)
+	}
+	steps := compileRules(nil, rules, matchs, indexes)
+	if len(steps) != 3 {
+		t.Fatalf("expect 3 steps, got %d", len(steps))
+	}
+	hosts := []string{
+		"ad.com", "bad.com", "x.ad.com", "cdn.ad.com", "mycdn.net", "a.cn", "notcn",
+		"google.com", "www.google.com", "x.org", "ushers.org", "she.com", "he.net", "example.com",
+	}
+	for _, host := range hosts {
+		mm := MatchMeta{Host: host}
+		want := -1
+		for i, m := range matchs {
+			if m(mm) {
+				want = i
+				break
+			}
+		}
+		got := -1
+		for _, step := range steps {
+			if got = step(mm); got >= 0 {
+				break
+			}
+		}
+		if got != want {
+			t.Errorf("host %s matched rule %d, want %d", host, got, want)
+		}
+	}
+}
+
+func TestDomainMatcher(t *testing.T) {
+	c, err := newGeoSiteCategory([]geosite.Domain{
+		{Type: geosite.DomainType_Domain, Value: "baidu.com"},
+		{Type: geosite.DomainType_Full, Value: "www.qq.com"},
+		{Type: geosite.DomainType_Plain, Value: "taobao"},
+		{Type: geosite.DomainType_Regex, Value: `^ad\d+\.`},
+		{Type: geosite.DomainType_Regex, Value: `^\D+\.Tracker\.net$`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newDomainMatcher()
+	m.Add(c, 0)
+	m.Build()
+	for host, want := range map[string]bool{
+		"baidu.com":         true,
+		"map.baidu.com":     true,
+		"notbaidu.com":      false,
+		"www.qq.com":        true,
+		"qq.com":            false,
+		"world.taobao.com":  true,
+		"ad12.example.com":  true,
+		"ad.example.com":    false,
+		"Pixel.tracker.net": true,
+		"p1.tracker.net":    false,
+	} {
+		if got := m.Match(host); got != want {
+			t.Errorf("Match(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func protoField(num int, value []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(num<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// writeTestGeoSite writes a geosite.dat of sites, values are prefixed with
+// "full:", "domain:", "regexp:" or "keyword:"
+func writeTestGeoSite(t *testing.T, sites map[string][]string) string {
+	types := map[string]geosite.DomainType{
+		"keyword": geosite.DomainType_Plain,
+		"regexp":  geosite.DomainType_Regex,
+		"domain":  geosite.DomainType_Domain,
+		"full":    geosite.DomainType_Full,
+	}
+	var raw []byte
+	for code, values := range sites {
+		site := protoField(1, []byte(code))
+		for _, v := range values {
+			typ, value, _ := strings.Cut(v, ":")
+			d := binary.AppendUvarint([]byte{1 << 3}, uint64(types[typ]))
+			d = append(d, protoField(2, []byte(value))...)
+			site = append(site, protoField(2, d)...)
+		}
+		raw = append(raw, protoField(1, site)...)
+	}
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRuleTableGeoSite(t *testing.T) {
+	path := writeTestGeoSite(t, map[string][]string{
+		"cn":  {"domain:qq.com", "full:www.baidu.com", "keyword:taobao"},
+		"ads": {"regexp:^ad\\d+\\.", "domain:ads.qq.com"},
+	})
+	pv := &FuncProvider{dns: newDNSCache(0, 0), geositePath: path}
+	tb, err := newRuleTable([]any{
+		"geosite: ads, reject",
+		"host-suffix: a.com, direct",
+		"geosite: cn, direct",
+		"host-match: ad, direct",
+		"match-all && geosite: cn, reject",
+	}, pv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first 4 rules are merged
+	if len(tb.steps) != 2 {
+		t.Fatalf("expect 2 steps, got %d", len(tb.steps))
+	}
+	for host, want := range map[string]int{
+		"ads.qq.com":      1,
+		"ad1.a.com":       1,
+		"x.a.com":         2,
+		"map.qq.com":      3,
+		"WWW.baidu.com":   3,
+		"baidu.com":       0,
+		"world.taobao.cn": 3,
+		"adx.com":         4,
+		"example.com":     0,
+	} {
+		h, _ := tb.match(MatchMeta{Host: host})
+		if h.index != want {
+			t.Errorf("host %s matched rule %d, want %d", host, h.index, want)
+		}
+	}
+	if pv.geosite != nil {
+		t.Error("expect geosite released after compiling")
+	}
+
+	// used categories are kept, others load the database again
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pv.geoSiteCategory("cn"); err != nil {
+		t.Errorf("expect cached category, got %v", err)
+	}
+	if _, err := pv.geoSiteCategory("us"); err == nil {
+		t.Error("expect load error")
+	}
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mengseeker/nlink/core/socks"
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+type RuleExplainStep struct {
+	// 1-based index in rules
+	Index   int
+	Rule    string
+	Matched bool
+	Lookups []LookupTrace
+}
+
+// RuleExplain shows how a decision is made
+type RuleExplain struct {
+	Steps []RuleExplainStep
+	// 1-based index of the matched rule, 0 if no rule matched
+	Matched int
+	Handler string
+}
+
+func (r Rule) String() string {
+	action := string(r.Action)
+	if r.ActionParam != "" {
+		action += ": " + r.ActionParam
+	}
+	return r.Expr.String() + ", " + action
+}
+
+// HandlerName returns the name of forward, or direct and reject
+func HandlerName(h RuleHandler) string {
+	switch h := h.(type) {
+	case *ruleStatsHandler:
+		return HandlerName(h.handler)
+	case Forward:
+		return string(RuleActionType_Forward) + ": " + h.Name()
+	case *DirectRuleHandler:
+		return string(RuleActionType_Direct)
+	case *RejectRuleHandler:
+		return string(RuleActionType_Reject)
+	default:
+		return fmt.Sprintf("%T", h)
+	}
+}
+
+// Explain evaluates rules one by one without the cache, and records the
+// lookups of each rule. Lookups of concurrent matches may be recorded too,
+// it is intended for a mapper not serving traffic.
+func (rm *RuleMapper) Explain(mm MatchMeta) RuleExplain {
+	t := rm.table.Load()
+	var exp RuleExplain
+	defer rm.pv.setTracer(nil)
+	for i, r := range t.rules {
+		step := RuleExplainStep{Index: i + 1, Rule: r.String()}
+		rm.pv.setTracer(func(l LookupTrace) {
+			step.Lookups = append(step.Lookups, l)
+		})
+		step.Matched = t.matchs[i](mm)
+		exp.Steps = append(exp.Steps, step)
+		if step.Matched {
+			exp.Matched = i + 1
+			exp.Handler = HandlerName(t.actions[i])
+			return exp
+		}
+	}
+	exp.Handler = HandlerName(&DirectRuleHandler{})
+	return exp
+}
+
+// explainForward stands for a server or group in NewExplainMapper,
+// it never connects.
+type explainForward struct {
+	name string
+}
+
+var errExplainForward = errors.New("explain only forward")
+
+func (f *explainForward) HTTPRequest(w http.ResponseWriter, r *http.Request) {
+	ResponseError(w, errExplainForward)
+}
+
+func (f *explainForward) Conn(conn net.Conn, remote *transform.Meta) {
+	conn.Close()
+}
+
+func (f *explainForward) Name() string           { return f.name }
+func (f *explainForward) Available() bool        { return true }
+func (f *explainForward) ActiveConns() int       { return 0 }
+func (f *explainForward) Latency() time.Duration { return 0 }
+func (f *explainForward) dial(ctx context.Context, sm *SelectMeta) (*ForwardClient, Conn, error) {
+	return nil, nil, errExplainForward
+}
+func (f *explainForward) roundTrip(r *http.Request, sm *SelectMeta) (*http.Response, error) {
+	return nil, errExplainForward
+}
+
+// NewExplainMapper creates the rule mapper of cfg without connecting to
+// servers or listening, the returned FuncProvider should be closed after use.
+func NewExplainMapper(cfg ProxyConfig) (*RuleMapper, *FuncProvider, error) {
+	pv, err := NewFuncProvider(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	forwards := map[string]Forward{}
+	for _, sc := range cfg.Servers {
+		forwards[sc.Name] = &explainForward{name: sc.Name}
+	}
+	for _, gc := range cfg.Groups {
+		forwards[gc.Name] = &explainForward{name: gc.Name}
+	}
+	mapper, err := NewRuleMapper(cfg.Rules, RuleCacheConfig{Size: -1}, pv, forwards)
+	if err != nil {
+		pv.Close()
+		return nil, nil, fmt.Errorf("parse rule err: %v", err)
+	}
+	return mapper, pv, nil
+}
+
+// NewMatchMeta creates MatchMeta of a connection to host:port
+func NewMatchMeta(host, port, inbound, network, srcIP string) (MatchMeta, error) {
+	mm := MatchMeta{
+		Schema:  "tcp",
+		Network: socks.TCP,
+		Host:    host,
+		Port:    port,
+		SrcIP:   srcIP,
+	}
+	var ok bool
+	if mm.Inbound, ok = inboundTypes[strings.ToLower(inbound)]; !ok {
+		return mm, fmt.Errorf("inbound must one of http, https-connect, socks4, socks5")
+	}
+	switch strings.ToLower(network) {
+	case "tcp":
+	case "udp":
+		mm.Network = socks.UDP
+	default:
+		return mm, fmt.Errorf("network must tcp or udp")
+	}
+	return mm, nil
+}
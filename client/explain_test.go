@@ -0,0 +1,67 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/mengseeker/nlink/core/socks"
+)
+
+func TestRuleMapperExplain(t *testing.T) {
+	mapper, pv, err := NewExplainMapper(ProxyConfig{
+		Servers: []ServerConfig{{Name: "tokyo"}},
+		Rules: []any{
+			"host-suffix: example.com, reject",
+			"geoip: CN, direct",
+			"match-all, forward: tokyo",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pv.Close()
+	defer mapper.Close()
+
+	mm, err := NewMatchMeta("1.1.1.1", "53", "socks5", "tcp", "192.168.1.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Inbound != socks.SOCKS5 || mm.Network != socks.TCP {
+		t.Errorf("unexpected match meta %+v", mm)
+	}
+	exp := mapper.Explain(mm)
+	if exp.Matched != 3 || exp.Handler != "forward: tokyo" || len(exp.Steps) != 3 {
+		t.Fatalf("unexpected explain %+v", exp)
+	}
+	if exp.Steps[0].Matched || len(exp.Steps[0].Lookups) != 0 {
+		t.Errorf("unexpected step 1 %+v", exp.Steps[0])
+	}
+	// ip literal is not resolved, only looked up in geoip
+	lookups := exp.Steps[1].Lookups
+	if exp.Steps[1].Matched || len(lookups) != 1 || lookups[0].Kind != "geoip" || lookups[0].Query != "1.1.1.1" {
+		t.Errorf("unexpected step 2 %+v", exp.Steps[1])
+	}
+	if !exp.Steps[2].Matched || exp.Steps[2].Rule != "match-all, forward: tokyo" {
+		t.Errorf("unexpected step 3 %+v", exp.Steps[2])
+	}
+
+	exp = mapper.Explain(MatchMeta{Host: "www.example.com", Port: "443"})
+	if exp.Matched != 1 || exp.Handler != "reject" || len(exp.Steps) != 1 {
+		t.Errorf("unexpected explain %+v", exp)
+	}
+
+	if _, err := NewMatchMeta("a.com", "443", "tun", "tcp", ""); err == nil {
+		t.Error("expect invalid inbound error")
+	}
+}
+
+func TestHandlerName(t *testing.T) {
+	for h, want := range map[RuleHandler]string{
+		&DirectRuleHandler{}: "direct",
+		&RejectRuleHandler{}: "reject",
+		newRuleStatsHandler(1, "", &explainForward{name: "tokyo"}): "forward: tokyo",
+	} {
+		if got := HandlerName(h); got != want {
+			t.Errorf("HandlerName(%T) = %q, want %q", h, got, want)
+		}
+	}
+}
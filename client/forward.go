@@ -1,11 +1,15 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mengseeker/nlink/core/log"
@@ -16,14 +20,38 @@ var (
 	logger = log.NewLogger()
 )
 
+// Forward is a server or a group of forwards
 type Forward interface {
 	RuleHandler
+
+	Name() string
+
+	// Available reports whether the forward can be selected by groups
+	Available() bool
+
+	// ActiveConns returns the number of in-flight streams
+	ActiveConns() int
+
+	// Latency returns the smoothed latency, 0 if not measured
+	Latency() time.Duration
+
+	// dial binds a stream to remote, returns the server owning the stream
+	dial(ctx context.Context, sm *SelectMeta) (*ForwardClient, Conn, error)
+
+	roundTrip(r *http.Request, sm *SelectMeta) (*http.Response, error)
 }
 
 type ForwardClient struct {
 	Config     ServerConfig
 	httpClient *http.Client
 	pool       *ConnPool
+	tlsConfig  *tls.Config
+	health     *HealthChecker
+	breaker    *CircuitBreaker
+	// streams held by the http transport, idle ones are kept for reuse
+	httpStreams atomic.Int64
+	// http requests waiting for the response or reading the body
+	httpRequests atomic.Int64
 }
 
 func NewForwardClient(config ServerConfig) (*ForwardClient, error) {
@@ -32,50 +60,187 @@ func NewForwardClient(config ServerConfig) (*ForwardClient, error) {
 		return nil, fmt.Errorf("create tls config err: %v", err)
 	}
 
-	pool := NewConnPool(config, func() (Conn, error) {
-		return transform.DialPackConn(config.Name, config.Addr, tlsConfig)
-	})
-
 	c := ForwardClient{
-		Config: config,
-		pool:   pool,
+		Config:    config,
+		tlsConfig: tlsConfig,
+		breaker:   NewCircuitBreaker(config.Name, config.CircuitBreaker),
+	}
+	// created before the pool, which starts goroutines
+	c.health, err = NewHealthChecker(config.Name, config.HealthCheck, c.healthProbe())
+	if err != nil {
+		return nil, fmt.Errorf("create health checker err: %v", err)
 	}
 
+	c.pool = NewConnPool(config, func(ctx context.Context) (Conn, error) {
+		return transform.DialPackConnContext(ctx, config.Name, config.Addr, tlsConfig)
+	})
+
 	c.httpClient = &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConns: 1000,
 			// IdleConnTimeout: 1 * time.Second,
 			IdleConnTimeout: 3 * time.Minute,
-			Dial: func(network, addr string) (net.Conn, error) {
-				conn, err := c.Dial(&transform.Meta{
-					Net:  "tcp",
-					Addr: addr,
-				})
-				if err != nil {
-					logger.Errorf("connect to remote failed: %v", err)
-					return nil, err
-				}
-				return &httpConn{
-					Conn: conn,
-					pl:   pool,
-				}, nil
-			},
+			Dial:            c.dialHTTP,
 		},
 	}
 
+	c.health.Start()
+
 	return &c, nil
 }
 
+func (f *ForwardClient) dialHTTP(network, addr string) (net.Conn, error) {
+	conn, err := f.Dial(&transform.Meta{
+		Net:  "tcp",
+		Addr: addr,
+	})
+	if err != nil {
+		logger.Errorf("connect to remote failed: %v", err)
+		return nil, err
+	}
+	f.httpStreams.Add(1)
+	return &httpConn{
+		Conn:    conn,
+		pl:      f.pool,
+		onClose: func() { f.httpStreams.Add(-1) },
+	}, nil
+}
+
+func (f *ForwardClient) healthProbe() HealthProbe {
+	switch f.Config.HealthCheck.Type {
+	case HealthCheckType_URL:
+		return f.recoverBreaker(NewURLProbe(f.Config.HealthCheck.URL, f.Config.HealthCheck.ExpectedStatus, f.dialProbe))
+	default:
+		return f.recoverBreaker(func(ctx context.Context) error {
+			conn, err := transform.DialPackConnContext(ctx, f.Config.Name, f.Config.Addr, f.tlsConfig)
+			if err != nil {
+				return err
+			}
+			return conn.Disconnect("health check")
+		})
+	}
+}
+
+// recoverBreaker closes the circuit breaker when probe succeeds, failures
+// are reported by the health state only
+func (f *ForwardClient) recoverBreaker(probe HealthProbe) HealthProbe {
+	return func(ctx context.Context) error {
+		err := probe(ctx)
+		if err == nil {
+			f.breaker.Recover()
+		}
+		return err
+	}
+}
+
+// dialProbe dials a dedicated tunnel connection for the url probe, it
+// bypasses the pool and the circuit breaker, so probes are sent while the
+// breaker is open and are not counted as streams. A successful probe
+// closes the breaker, see recoverBreaker.
+func (f *ForwardClient) dialProbe(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := transform.DialPackConnContext(ctx, f.Config.Name, f.Config.Addr, f.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(&transform.Meta{Net: "tcp", Addr: addr}); err != nil {
+		conn.Disconnect("health check bind error")
+		return nil, err
+	}
+	return &probeConn{PackConn: conn}, nil
+}
+
+type probeConn struct {
+	*transform.PackConn
+}
+
+func (c *probeConn) Close() error {
+	return c.Disconnect("health check")
+}
+
+// Close stops the health checker and closes the pool
+func (f *ForwardClient) Close() error {
+	f.health.Stop()
+	f.httpClient.CloseIdleConnections()
+	return f.pool.Close()
+}
+
+func (f *ForwardClient) Name() string {
+	return f.Config.Name
+}
+
+// HealthState returns the state reported by the health checker,
+// always unknown if health check is disabled.
+func (f *ForwardClient) HealthState() HealthState {
+	return f.health.State()
+}
+
+// Latency returns the smoothed latency measured by the health checker,
+// 0 if health check is disabled or not succeeded yet.
+func (f *ForwardClient) Latency() time.Duration {
+	return f.health.Latency()
+}
+
+// ActiveConns returns the number of in-flight streams to the server.
+// Streams of the http transport are counted by in-flight requests, the
+// idle keep-alive ones are not.
+func (f *ForwardClient) ActiveConns() int {
+	n := int64(f.pool.ConnCount()) - f.httpStreams.Load() + f.httpRequests.Load()
+	if n < 0 {
+		// streams disconnected by closing the pool
+		return 0
+	}
+	return int(n)
+}
+
+func (f *ForwardClient) PoolStats() PoolStats {
+	return f.pool.Stats()
+}
+
+// Healthy reports whether the server can be used, a server that has
+// never been checked is treated as healthy.
+func (f *ForwardClient) Healthy() bool {
+	return f.health.State() != HealthState_Down
+}
+
+// BreakerState returns the state of the circuit breaker around Dial
+func (f *ForwardClient) BreakerState() BreakerState {
+	return f.breaker.State()
+}
+
+// Available reports whether the server is healthy and its circuit
+// breaker lets dials through, used by groups to skip servers.
+func (f *ForwardClient) Available() bool {
+	return f.Healthy() && f.breaker.Ready()
+}
+
 func (f *ForwardClient) Dial(remote *transform.Meta) (Conn, error) {
-	return f.pool.DialRemote(remote)
+	return f.DialContext(context.Background(), remote)
+}
+
+func (f *ForwardClient) DialContext(ctx context.Context, remote *transform.Meta) (Conn, error) {
+	if err := f.breaker.Allow(); err != nil {
+		return nil, &DialError{Server: f.Config.Name, Err: err}
+	}
+	conn, err := f.pool.DialRemoteContext(ctx, remote)
+	if errors.Is(err, ErrPoolExhausted) {
+		f.breaker.Cancel()
+	} else {
+		f.breaker.Report(err)
+	}
+	if err != nil {
+		return nil, &DialError{Server: f.Config.Name, Err: err}
+	}
+	return conn, nil
+}
+
+func (f *ForwardClient) dial(ctx context.Context, sm *SelectMeta) (*ForwardClient, Conn, error) {
+	conn, err := f.DialContext(ctx, sm.Remote)
+	return f, conn, err
 }
 
 func (f *ForwardClient) HTTPRequest(w http.ResponseWriter, r *http.Request) {
-	resp, err := f.httpClient.Do(r)
+	resp, err := f.roundTrip(r, nil)
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			err = errors.New("remote server close connection")
-		}
 		ResponseError(w, err)
 		return
 	}
@@ -83,17 +248,55 @@ func (f *ForwardClient) HTTPRequest(w http.ResponseWriter, r *http.Request) {
 	CopyHTTPResponse(w, resp)
 }
 
+func (f *ForwardClient) roundTrip(r *http.Request, sm *SelectMeta) (*http.Response, error) {
+	f.httpRequests.Add(1)
+	resp, err := f.httpClient.Do(r)
+	if err != nil {
+		f.httpRequests.Add(-1)
+		if errors.Is(err, io.EOF) {
+			err = errors.New("remote server close connection")
+		}
+		return nil, err
+	}
+	// in flight until the body is closed
+	resp.Body = &cancelReadCloser{
+		ReadCloser: resp.Body,
+		cancel:     sync.OnceFunc(func() { f.httpRequests.Add(-1) }),
+	}
+	return resp, nil
+}
+
 func (f *ForwardClient) Conn(conn net.Conn, remote *transform.Meta) {
-	defer conn.Close()
 	l := logger.With("remote", remote.String())
 	remoteConn, err := f.Dial(remote)
 	if err != nil {
+		conn.Close()
 		l.Errorf("connect to remote failed: %v", err)
 		return
 	}
+	f.transform(conn, remoteConn, l)
+}
 
+// transform copies data between conn and remoteConn returned by Dial
+func (f *ForwardClient) transform(conn net.Conn, remoteConn Conn, l *log.Logger) {
+	defer conn.Close()
 	defer f.pool.Put(remoteConn)
 	defer remoteConn.Close()
 
 	transform.TransformConn(conn, remoteConn, l)
 }
+
+// DialError is returned when failed to bind a stream on the server,
+// no payload has been sent to remote yet.
+type DialError struct {
+	Server string
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial server %s err: %v", e.Server, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
@@ -1,42 +1,292 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mengseeker/nlink/core/transform"
 )
 
+const (
+	DefaultGroupDialTimeout = 10 * time.Second
+)
+
 type ForwardGroup struct {
 	cfg      ForwardGroupConfig
-	servers  []*ForwardClient
+	closed   atomic.Bool
+	members  []Forward
 	selecter Selecter
+	// not nil if the selecter type is select
+	manual *ManualSelecter
 }
 
 type ForwardGroupConfig struct {
-	Name     string
+	Name string
+
+	// names of servers or other groups
 	Servers  []string
 	Selecter SelecterConfig
+
+	// max members tried when dial failed, default is the number of members
+	MaxAttempts int
+
+	// total time limit of all attempts, default is DefaultGroupDialTimeout
+	DialTimeout time.Duration
 }
 
-func NewForwardGroup(clients map[string]*ForwardClient, config ForwardGroupConfig) (*ForwardGroup, error) {
-	servers := []*ForwardClient{}
-	for _, server := range config.Servers {
-		servers = append(servers, clients[server])
-		if clients[server] == nil {
-			return nil, errors.New("not found server: " + server)
+func NewForwardGroup(forwards map[string]Forward, config ForwardGroupConfig, store *SelectStore) (*ForwardGroup, error) {
+	members := []Forward{}
+	for _, name := range config.Servers {
+		if forwards[name] == nil {
+			return nil, errors.New("not found server or group: " + name)
 		}
+		members = append(members, forwards[name])
 	}
-	selecter, err := NewSelecter(servers, config.Selecter)
+	if config.MaxAttempts <= 0 || config.MaxAttempts > len(members) {
+		config.MaxAttempts = len(members)
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultGroupDialTimeout
+	}
+	g := &ForwardGroup{
+		cfg:     config,
+		members: members,
+	}
+	if config.Selecter.Type == SelecterType_Select {
+		if len(members) == 0 {
+			return nil, errors.New("selecter members must not empty")
+		}
+		g.manual = NewManualSelecter(config.Name, members, store)
+		g.selecter = g.manual.Select
+		return g, nil
+	}
+	selecter, err := NewSelecter(members, config.Selecter)
 	if err != nil {
 		return nil, err
 	}
-	return &ForwardGroup{
-		cfg:      config,
-		servers:  servers,
-		selecter: selecter,
-	}, nil
+	g.selecter = selecter
+	return g, nil
+}
+
+// NewForwardGroups creates groups in dependency order, so a group can
+// reference groups defined after it. Reference cycles are reported as error.
+func NewForwardGroups(clients map[string]*ForwardClient, configs []ForwardGroupConfig, store *SelectStore) (map[string]*ForwardGroup, error) {
+	cfgs := map[string]ForwardGroupConfig{}
+	for _, gc := range configs {
+		if _, ok := clients[gc.Name]; ok {
+			return nil, fmt.Errorf("group name conflict with server name: %s", gc.Name)
+		}
+		if _, ok := cfgs[gc.Name]; ok {
+			return nil, fmt.Errorf("duplicate group name: %s", gc.Name)
+		}
+		cfgs[gc.Name] = gc
+	}
+
+	forwards := map[string]Forward{}
+	for name, fc := range clients {
+		forwards[name] = fc
+	}
+	groups := map[string]*ForwardGroup{}
+	visiting := map[string]bool{}
+	var path []string
+	var build func(name string) error
+	build = func(name string) error {
+		if _, ok := groups[name]; ok {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("group reference cycle: %s -> %s", strings.Join(path, " -> "), name)
+		}
+		visiting[name] = true
+		path = append(path, name)
+		gc := cfgs[name]
+		for _, member := range gc.Servers {
+			if _, ok := cfgs[member]; ok {
+				if err := build(member); err != nil {
+					return err
+				}
+			}
+		}
+		g, err := NewForwardGroup(forwards, gc, store)
+		if err != nil {
+			return fmt.Errorf("new group %s err: %v", name, err)
+		}
+		path = path[:len(path)-1]
+		visiting[name] = false
+		groups[name] = g
+		forwards[name] = g
+		return nil
+	}
+	for _, gc := range configs {
+		if err := build(gc.Name); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (f *ForwardGroup) Name() string {
+	return f.cfg.Name
+}
+
+var ErrGroupClosed = errors.New("group closed")
+
+// Close makes the group reject new dials and requests, members may be
+// shared by other groups and are closed by their owner.
+func (f *ForwardGroup) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+func (f *ForwardGroup) Members() []Forward {
+	return f.members
+}
+
+// Selected returns the member chosen by user, empty if the group is not
+// a select group.
+func (f *ForwardGroup) Selected() string {
+	if f.manual == nil {
+		return ""
+	}
+	return f.manual.Selected().Name()
+}
+
+// Select changes the member of a select group
+func (f *ForwardGroup) Select(name string) error {
+	if f.manual == nil {
+		return fmt.Errorf("group %s selecter type is %q, not %q", f.cfg.Name, f.cfg.Selecter.Type, SelecterType_Select)
+	}
+	return f.manual.Set(name)
+}
+
+// Available reports whether any member is available
+func (f *ForwardGroup) Available() bool {
+	if f.closed.Load() {
+		return false
+	}
+	for _, m := range f.members {
+		if m.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ForwardGroup) ActiveConns() int {
+	n := 0
+	for _, m := range f.members {
+		n += m.ActiveConns()
+	}
+	return n
+}
+
+// Latency returns the lowest latency of available members
+func (f *ForwardGroup) Latency() time.Duration {
+	var latency time.Duration
+	for _, m := range f.members {
+		if l := m.Latency(); l != 0 && m.Available() && (latency == 0 || l < latency) {
+			latency = l
+		}
+	}
+	return latency
+}
+
+// try selects members and calls fn until fn succeeds or returns an error
+// other than DialError, tried members are excluded from the next selection.
+func (f *ForwardGroup) try(ctx context.Context, parent *SelectMeta, attempts int, fn func(ctx context.Context, m Forward, sm *SelectMeta) error) (err error) {
+	if f.closed.Load() {
+		return &DialError{Server: f.cfg.Name, Err: ErrGroupClosed}
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.DialTimeout)
+	defer cancel()
+	l := logger.With("group", f.cfg.Name, "remote", parent.Remote.String())
+	sm := &SelectMeta{
+		Remote:  parent.Remote,
+		Source:  parent.Source,
+		Exclude: map[Forward]bool{},
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		m, serr := f.selecter(sm)
+		if serr != nil {
+			if err == nil {
+				// let the parent group try its next member
+				err = &DialError{Server: f.cfg.Name, Err: serr}
+			}
+			return
+		}
+		err = fn(ctx, m, sm)
+		var de *DialError
+		if err == nil {
+			if attempt > 1 {
+				l.Infof("handled by %s after %d attempts", m.Name(), attempt)
+			} else {
+				l.Debugf("handled by %s", m.Name())
+			}
+			return nil
+		}
+		if !errors.As(err, &de) {
+			return
+		}
+		if ctx.Err() != nil {
+			l.Warnf("%s failed and dial timeout: %v", m.Name(), err)
+			return
+		}
+		l.Warnf("%s failed, try next: %v", m.Name(), err)
+		sm.Exclude[m] = true
+	}
+	return
+}
+
+func (f *ForwardGroup) dial(ctx context.Context, sm *SelectMeta) (fc *ForwardClient, conn Conn, err error) {
+	err = f.try(ctx, sm, f.cfg.MaxAttempts, func(ctx context.Context, m Forward, sm *SelectMeta) (err error) {
+		fc, conn, err = m.dial(ctx, sm)
+		return err
+	})
+	return
+}
+
+func (f *ForwardGroup) roundTrip(r *http.Request, sm *SelectMeta) (resp *http.Response, err error) {
+	attempts := f.cfg.MaxAttempts
+	if r.Body != nil && r.Body != http.NoBody {
+		// request body may be consumed, can not be sent again
+		attempts = 1
+	}
+	err = f.try(r.Context(), sm, attempts, func(ctx context.Context, m Forward, sm *SelectMeta) (err error) {
+		// DialTimeout limits waiting for the response header, the body
+		// is read after try returns and ctx is canceled.
+		reqCtx, cancel := context.WithCancel(r.Context())
+		stop := context.AfterFunc(ctx, cancel)
+		resp, err = m.roundTrip(r.WithContext(reqCtx), sm)
+		if !stop() || err != nil {
+			cancel()
+			if err == nil {
+				resp.Body.Close()
+				err = ctx.Err()
+			}
+			return err
+		}
+		resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+		return nil
+	})
+	return
+}
+
+// cancelReadCloser cancels the request context when the body is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (rc *cancelReadCloser) Close() error {
+	defer rc.cancel()
+	return rc.ReadCloser.Close()
 }
 
 func (f *ForwardGroup) HTTPRequest(w http.ResponseWriter, r *http.Request) {
@@ -44,19 +294,21 @@ func (f *ForwardGroup) HTTPRequest(w http.ResponseWriter, r *http.Request) {
 		Net:  "tcp",
 		Addr: r.URL.Host,
 	}
-	fc, err := f.selecter(remote)
+	resp, err := f.roundTrip(r, &SelectMeta{Remote: remote, Source: r.RemoteAddr})
 	if err != nil {
 		ResponseError(w, err)
 		return
 	}
-	fc.HTTPRequest(w, r)
+	defer resp.Body.Close()
+	CopyHTTPResponse(w, resp)
 }
 
 func (f *ForwardGroup) Conn(conn net.Conn, remote *transform.Meta) {
-	fc, err := f.selecter(remote)
+	fc, remoteConn, err := f.dial(context.Background(), &SelectMeta{Remote: remote, Source: conn.RemoteAddr().String()})
 	if err != nil {
 		conn.Close()
+		logger.With("group", f.cfg.Name, "remote", remote.String()).Errorf("connect to remote failed: %v", err)
 		return
 	}
-	fc.Conn(conn, remote)
+	fc.transform(conn, remoteConn, logger.With("remote", remote.String()))
 }
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+// fakeForward fails every dial and round trip if fail is set
+type fakeForward struct {
+	name  string
+	fail  bool
+	calls int
+}
+
+func (f *fakeForward) HTTPRequest(w http.ResponseWriter, r *http.Request) {}
+func (f *fakeForward) Conn(conn net.Conn, remote *transform.Meta)         {}
+func (f *fakeForward) Name() string                                       { return f.name }
+func (f *fakeForward) Available() bool                                    { return true }
+func (f *fakeForward) ActiveConns() int                                   { return 0 }
+func (f *fakeForward) Latency() time.Duration                             { return 0 }
+
+func (f *fakeForward) dial(ctx context.Context, sm *SelectMeta) (*ForwardClient, Conn, error) {
+	f.calls++
+	if f.fail {
+		return nil, nil, &DialError{Server: f.name, Err: errors.New("refused")}
+	}
+	return nil, nil, nil
+}
+
+func (f *fakeForward) roundTrip(r *http.Request, sm *SelectMeta) (*http.Response, error) {
+	f.calls++
+	if f.fail {
+		return nil, &DialError{Server: f.name, Err: errors.New("refused")}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(f.name))}, nil
+}
+
+// blockForward blocks round trips until the request is canceled
+type blockForward struct {
+	fakeForward
+}
+
+func (f *blockForward) roundTrip(r *http.Request, sm *SelectMeta) (*http.Response, error) {
+	<-r.Context().Done()
+	return nil, &DialError{Server: f.name, Err: r.Context().Err()}
+}
+
+func newTestGroup(t *testing.T, cfg ForwardGroupConfig, members ...Forward) *ForwardGroup {
+	forwards := map[string]Forward{}
+	for _, m := range members {
+		forwards[m.Name()] = m
+		cfg.Servers = append(cfg.Servers, m.Name())
+	}
+	cfg.Name = "group"
+	cfg.Selecter.Type = SelecterType_FrontFirst
+	g, err := NewForwardGroup(forwards, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestForwardGroupFailover(t *testing.T) {
+	a, b := &fakeForward{name: "a", fail: true}, &fakeForward{name: "b"}
+	g := newTestGroup(t, ForwardGroupConfig{}, a, b)
+	sm := &SelectMeta{Remote: &transform.Meta{Net: "tcp", Addr: "example.com:80"}}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, err := g.roundTrip(r, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "b" || a.calls != 1 || b.calls != 1 {
+		t.Errorf("expect handled by b after a failed, got %q, calls a=%d b=%d", body, a.calls, b.calls)
+	}
+
+	if _, _, err := g.dial(context.Background(), sm); err != nil {
+		t.Errorf("dial expect failover to b, got %v", err)
+	}
+}
+
+func TestForwardGroupMaxAttempts(t *testing.T) {
+	a, b, c := &fakeForward{name: "a", fail: true}, &fakeForward{name: "b", fail: true}, &fakeForward{name: "c"}
+	g := newTestGroup(t, ForwardGroupConfig{MaxAttempts: 2}, a, b, c)
+	sm := &SelectMeta{Remote: &transform.Meta{Net: "tcp", Addr: "example.com:80"}}
+
+	_, _, err := g.dial(context.Background(), sm)
+	var de *DialError
+	if !errors.As(err, &de) || de.Server != "b" {
+		t.Errorf("expect the dial error of b, got %v", err)
+	}
+	if c.calls != 0 {
+		t.Errorf("c tried after max attempts")
+	}
+}
+
+func TestForwardGroupDialTimeout(t *testing.T) {
+	a := &blockForward{fakeForward{name: "a"}}
+	g := newTestGroup(t, ForwardGroupConfig{DialTimeout: 50 * time.Millisecond}, a)
+	sm := &SelectMeta{Remote: &transform.Meta{Net: "tcp", Addr: "example.com:80"}}
+
+	start := time.Now()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, err := g.roundTrip(r, sm); err == nil {
+		t.Fatal("expect timeout error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("round trip not bounded by dial timeout, took %s", d)
+	}
+}
+
+func TestNewForwardGroups(t *testing.T) {
+	clients := map[string]*ForwardClient{
+		"s1": newTestForwardClient("s1"),
+		"s2": newTestForwardClient("s2"),
+	}
+	group := func(name string, servers ...string) ForwardGroupConfig {
+		return ForwardGroupConfig{Name: name, Servers: servers, Selecter: SelecterConfig{Type: SelecterType_FrontFirst}}
+	}
+	cases := []struct {
+		name    string
+		configs []ForwardGroupConfig
+		err     string
+	}{
+		{"cycle", []ForwardGroupConfig{group("a", "b"), group("b", "a")}, "cycle"},
+		{"self reference", []ForwardGroupConfig{group("a", "s1", "a")}, "cycle"},
+		{"server name", []ForwardGroupConfig{group("s1", "s2")}, "conflict"},
+		{"duplicate", []ForwardGroupConfig{group("a", "s1"), group("a", "s2")}, "duplicate"},
+		{"forward reference", []ForwardGroupConfig{group("a", "b", "s1"), group("b", "s2")}, ""},
+	}
+	for _, c := range cases {
+		groups, err := NewForwardGroups(clients, c.configs, nil)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expect %s error, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		// b is built before a references it
+		if members := groups["a"].Members(); len(members) != 2 || members[0] != groups["b"] {
+			t.Errorf("%s: unexpected members %v", c.name, members)
+		}
+	}
+}
+
+func TestForwardGroupNestedFailover(t *testing.T) {
+	a, b, c := &fakeForward{name: "a", fail: true}, &fakeForward{name: "b", fail: true}, &fakeForward{name: "c"}
+	newGroup := func(forwards map[string]Forward, name string, servers ...string) *ForwardGroup {
+		g, err := NewForwardGroup(forwards, ForwardGroupConfig{
+			Name:     name,
+			Servers:  servers,
+			Selecter: SelecterConfig{Type: SelecterType_FrontFirst},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	forwards := map[string]Forward{"a": a, "b": b, "c": c}
+	forwards["child"] = newGroup(forwards, "child", "a", "b")
+	parent := newGroup(forwards, "parent", "child", "c")
+	sm := &SelectMeta{Remote: &transform.Meta{Net: "tcp", Addr: "example.com:80"}}
+
+	// every member of child fails, the parent tries c
+	if _, _, err := parent.dial(context.Background(), sm); err != nil {
+		t.Fatalf("expect failover to c, got %v", err)
+	}
+	if a.calls != 1 || b.calls != 1 || c.calls != 1 {
+		t.Errorf("calls a=%d b=%d c=%d", a.calls, b.calls, c.calls)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, err := parent.roundTrip(r, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "c" {
+		t.Errorf("expect handled by c, got %q", body)
+	}
+}
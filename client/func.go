@@ -4,31 +4,96 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mengseeker/nlink/core/geoip"
+	"github.com/mengseeker/nlink/core/geosite"
 	"github.com/mengseeker/nlink/core/resolver"
 )
 
 type FuncProvider struct {
-	resolvers []resolver.Resolver
-	hosts     map[string]net.IP
-	servers   map[string]bool
+	resolvers  []resolver.Resolver
+	preference resolver.IPPreference
+	hosts      map[string]net.IP
+	servers    map[string]bool
+	ruleSets   map[string]*RuleProvider
+	// resolved addresses, shared by rules and direct dialing
+	dns *dnsCache
+	// http client of direct rules, dials with the resolved addresses
+	direct *http.Client
+
+	// loaded on first use
+	geoipConfig geoip.Config
+	geoipOnce   sync.Once
+	geoip       *geoip.DB
+	geoipErr    error
+	geoipLock   sync.Mutex
+	// called after the geoip databases are reloaded
+	geoipReload []func()
+	geositePath string
+	geositeLock sync.Mutex
+	// released after rules are compiled, see releaseGeoSite
+	geosite *geosite.DB
+	// compiled categories by condition param, kept after release
+	geositeCategories map[string]*geositeCategory
+
+	// records lookups, see RuleMapper.Explain
+	tracer atomic.Pointer[func(LookupTrace)]
+}
+
+// LookupTrace is a DNS or GeoIP lookup done while matching rules
+type LookupTrace struct {
+	Kind   string
+	Query  string
+	Result string
+}
+
+func (pv *FuncProvider) trace(kind, query, result string) {
+	if pv == nil {
+		return
+	}
+	if fn := pv.tracer.Load(); fn != nil {
+		(*fn)(LookupTrace{Kind: kind, Query: query, Result: result})
+	}
+}
+
+// setTracer sets fn called on every lookup, nil to remove it
+func (pv *FuncProvider) setTracer(fn func(LookupTrace)) {
+	if fn == nil {
+		pv.tracer.Store(nil)
+		return
+	}
+	pv.tracer.Store(&fn)
 }
 
-func NewFuncProvider(rc []ResolverConfig, servers []ServerConfig) (pv *FuncProvider, err error) {
+func NewFuncProvider(cfg ProxyConfig) (pv *FuncProvider, err error) {
 	pv = &FuncProvider{
-		resolvers: make([]resolver.Resolver, 0),
-		servers:   map[string]bool{},
+		resolvers:   make([]resolver.Resolver, 0),
+		servers:     map[string]bool{},
+		ruleSets:    map[string]*RuleProvider{},
+		preference:  cfg.IPPreference,
+		dns:         newDNSCache(cfg.RuleCache.Size, cfg.RuleCache.DNSTTL),
+		geoipConfig: cfg.GeoIP,
+		geositePath: cfg.GeoSite,
 	}
 
-	for _, sc := range servers {
+	for _, sc := range cfg.Servers {
 		pv.servers[sc.Name] = true
 	}
 
+	if !pv.preference.Valid() {
+		return nil, fmt.Errorf("invalid ip preference %q", pv.preference)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = pv.DialContext
+	pv.direct = &http.Client{Transport: transport}
+
 	// init resolvers
-	for _, c := range rc {
+	for _, c := range cfg.Resolver {
 		if c.DNS != "" {
 			rcs, err := resolver.NewDNSResolver(c.DNS)
 			if err != nil {
@@ -47,14 +112,9 @@ func NewFuncProvider(rc []ResolverConfig, servers []ServerConfig) (pv *FuncProvi
 	if len(pv.resolvers) == 0 {
 		rcs, err := resolver.NewLocalResolver()
 		if err != nil {
-			pv.resolvers = append(pv.resolvers, rcs)
+			return nil, fmt.Errorf("new local resolver err: %s", err)
 		}
-	}
-
-	// init geoip
-	err = geoip.InitDB()
-	if err != nil {
-		return
+		pv.resolvers = append(pv.resolvers, rcs)
 	}
 
 	// load hosts
@@ -63,34 +123,213 @@ func NewFuncProvider(rc []ResolverConfig, servers []ServerConfig) (pv *FuncProvi
 		return
 	}
 
+	// load rule providers
+	for _, c := range cfg.RuleProviders {
+		if pv.ruleSets[c.Name] != nil {
+			pv.Close()
+			return nil, fmt.Errorf("duplicate rule provider name: %s", c.Name)
+		}
+		p, err := NewRuleProvider(c)
+		if err != nil {
+			pv.Close()
+			return nil, err
+		}
+		p.Start()
+		pv.ruleSets[c.Name] = p
+	}
+
 	return pv, nil
 }
 
+// GeoIP opens the geoip databases on first call
+func (pv *FuncProvider) GeoIP() (*geoip.DB, error) {
+	if pv == nil {
+		return nil, fmt.Errorf("geoip database is not loaded")
+	}
+	pv.geoipOnce.Do(func() {
+		pv.geoip, pv.geoipErr = geoip.Open(pv.geoipConfig)
+		if pv.geoipErr == nil {
+			pv.geoip.OnReload(func() {
+				pv.geoipLock.Lock()
+				fns := pv.geoipReload
+				pv.geoipLock.Unlock()
+				for _, fn := range fns {
+					fn()
+				}
+			})
+		}
+	})
+	return pv.geoip, pv.geoipErr
+}
+
+// OnGeoIPReload registers fn called after the geoip databases are reloaded,
+// the databases may be loaded later.
+func (pv *FuncProvider) OnGeoIPReload(fn func()) {
+	pv.geoipLock.Lock()
+	defer pv.geoipLock.Unlock()
+	pv.geoipReload = append(pv.geoipReload, fn)
+}
+
 func (pv *FuncProvider) GEOIP(ip net.IP) string {
-	return geoip.Country(ip)
+	db, err := pv.GeoIP()
+	if err != nil {
+		return ""
+	}
+	country := db.Country(ip)
+	pv.trace("geoip", ip.String(), country)
+	return country
+}
+
+// ASN returns the autonomous system number of ip, 0 if unknown
+func (pv *FuncProvider) ASN(ip net.IP) uint {
+	db, err := pv.GeoIP()
+	if err != nil {
+		return 0
+	}
+	number, org, err := db.ASN(ip)
+	if err != nil {
+		logger.Debugf("lookup asn of %s err: %v", ip, err)
+	}
+	pv.trace("asn", ip.String(), fmt.Sprintf("%d %s", number, org))
+	return number
 }
 
 func (pv *FuncProvider) HasServer(name string) bool {
 	return pv.servers[name]
 }
 
-func (pv *FuncProvider) Resolv(domain string) (IP net.IP) {
-	records := make(chan net.IP)
-	defer close(records)
+// GeoSite loads the geosite database, from the configured file or the
+// embedded one. It is loaded again after released.
+func (pv *FuncProvider) GeoSite() (*geosite.DB, error) {
+	if pv == nil {
+		return nil, fmt.Errorf("geosite database is not loaded")
+	}
+	pv.geositeLock.Lock()
+	defer pv.geositeLock.Unlock()
+	return pv.loadGeoSite()
+}
+
+// loadGeoSite must be called with geositeLock held
+func (pv *FuncProvider) loadGeoSite() (db *geosite.DB, err error) {
+	if pv.geosite != nil {
+		return pv.geosite, nil
+	}
+	if pv.geositePath != "" {
+		db, err = geosite.Load(pv.geositePath)
+	} else {
+		db, err = geosite.Embedded()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("geosite loaded %d categories", len(db.Codes()))
+	pv.geosite = db
+	return db, nil
+}
+
+// geoSiteCategory returns the category of param "code[@attr...]" of geosite
+// condition, e.g. "cn", "category-ads-all@ads", "geolocation-!cn@!cn".
+// Each param is compiled once.
+func (pv *FuncProvider) geoSiteCategory(param string) (*geositeCategory, error) {
+	parts := strings.Split(param, "@")
+	if parts[0] == "" {
+		return nil, fmt.Errorf("params must not empty")
+	}
+	if pv == nil {
+		return nil, fmt.Errorf("geosite database is not loaded")
+	}
+	pv.geositeLock.Lock()
+	defer pv.geositeLock.Unlock()
+	if c, ok := pv.geositeCategories[param]; ok {
+		return c, nil
+	}
+	db, err := pv.loadGeoSite()
+	if err != nil {
+		return nil, err
+	}
+	domains, ok := db.Domains(parts[0], parts[1:]...)
+	if !ok {
+		return nil, fmt.Errorf("category %q not found in geosite", parts[0])
+	}
+	c, err := newGeoSiteCategory(domains)
+	if err != nil {
+		return nil, err
+	}
+	if pv.geositeCategories == nil {
+		pv.geositeCategories = map[string]*geositeCategory{}
+	}
+	pv.geositeCategories[param] = c
+	return c, nil
+}
+
+// releaseGeoSite drops the parsed database once rules are compiled, only
+// the used categories are kept
+func (pv *FuncProvider) releaseGeoSite() {
+	if pv == nil {
+		return
+	}
+	pv.geositeLock.Lock()
+	pv.geosite = nil
+	pv.geositeLock.Unlock()
+}
+
+// RuleProvider returns the rule provider named name, nil if not found
+func (pv *FuncProvider) RuleProvider(name string) *RuleProvider {
+	if pv == nil {
+		return nil
+	}
+	return pv.ruleSets[name]
+}
+
+// Close stops watching rule provider files
+func (pv *FuncProvider) Close() error {
+	for _, p := range pv.ruleSets {
+		p.Close()
+	}
+	// the database is not opened after closed
+	pv.geoipOnce.Do(func() {})
+	if pv.geoip != nil {
+		pv.geoip.Close()
+	}
+	return nil
+}
+
+// Resolv returns the addresses of domain ordered by the ip preference,
+// the first one is preferred for dialing. Results are cached, concurrent
+// calls of the same domain share one lookup.
+func (pv *FuncProvider) Resolv(domain string) []net.IP {
+	if ip := net.ParseIP(domain); ip != nil {
+		return []net.IP{ip}
+	}
+	ips := pv.dns.Lookup(normalizeDomain(domain), func(domain string) []net.IP {
+		return pv.preference.Sort(pv.resolv(domain))
+	})
+	if len(ips) == 0 {
+		pv.trace("resolve", domain, "failed")
+	} else {
+		pv.trace("resolve", domain, fmt.Sprint(ips))
+	}
+	return ips
+}
+
+func (pv *FuncProvider) resolv(domain string) (IPs []net.IP) {
+	if len(pv.resolvers) == 0 {
+		return nil
+	}
+	// only the first result is sent, buffered so that late resolvers
+	// never block or send on a closed channel
+	records := make(chan []net.IP, 1)
 	tctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	var i atomic.Bool
 	call := func(rl resolver.Resolver) {
-		ip, err := rl.Resolv(tctx, domain)
+		ips, err := rl.Resolv(tctx, domain)
 		if err != nil {
 			logger.Debugf("lookup %s err: %v", domain, err)
 			return
 		}
 		if i.CompareAndSwap(false, true) {
-			select {
-			case records <- ip:
-			case <-tctx.Done():
-			}
+			records <- ips
 		}
 	}
 	for i := range pv.resolvers {
@@ -98,8 +337,8 @@ func (pv *FuncProvider) Resolv(domain string) (IP net.IP) {
 	}
 
 	select {
-	case ip := <-records:
-		return ip
+	case ips := <-records:
+		return ips
 	case <-tctx.Done():
 		return nil
 	}
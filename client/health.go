@@ -0,0 +1,258 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HealthCheckType string
+
+const (
+	// dial a new tunnel connection to the server and finish the tls handshake
+	HealthCheckType_Handshake HealthCheckType = "handshake"
+	// request the probe url through the tunnel
+	HealthCheckType_URL HealthCheckType = "url"
+)
+
+const (
+	// smoothing factor of the latency EWMA, bigger follows changes faster
+	HealthCheckLatencyAlpha = 0.3
+
+	DefaultHealthCheckTimeout       = 5 * time.Second
+	DefaultHealthCheckUpThreshold   = 1
+	DefaultHealthCheckDownThreshold = 3
+)
+
+type HealthCheckConfig struct {
+	Type HealthCheckType
+
+	// check interval, health check is disabled when zero
+	Interval time.Duration
+
+	// timeout of a single probe
+	Timeout time.Duration
+
+	// probe url, required by url type
+	URL string
+
+	// expected status code of the probe url, any 2xx or 3xx if zero
+	ExpectedStatus int
+
+	// consecutive successes needed to mark the server up
+	UpThreshold int
+
+	// consecutive failures needed to mark the server down
+	DownThreshold int
+}
+
+func (c HealthCheckConfig) Enabled() bool {
+	return c.Interval > 0
+}
+
+type HealthState int32
+
+const (
+	HealthState_Unknown HealthState = iota
+	HealthState_Up
+	HealthState_Down
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthState_Up:
+		return "up"
+	case HealthState_Down:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+type HealthProbe func(ctx context.Context) error
+
+// NewURLProbe returns a probe requesting url on connections of dial,
+// redirects are not followed.
+func NewURLProbe(url string, expectedStatus int, dial func(ctx context.Context, network, addr string) (net.Conn, error)) HealthProbe {
+	// no keepalive, every probe dials a new connection
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext:       dial,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if expectedStatus != 0 {
+			if resp.StatusCode != expectedStatus {
+				return fmt.Errorf("unexpected status %s, want %d", resp.Status, expectedStatus)
+			}
+		} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+type HealthChecker struct {
+	Name   string
+	Config HealthCheckConfig
+
+	probe HealthProbe
+	state atomic.Int32
+	// smoothed latency of successful probes in nanoseconds, 0 if not measured
+	latency atomic.Int64
+
+	lock      sync.Mutex
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastErr   error
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewHealthChecker(name string, cfg HealthCheckConfig, probe HealthProbe) (*HealthChecker, error) {
+	if cfg.Type == "" {
+		cfg.Type = HealthCheckType_Handshake
+	}
+	switch cfg.Type {
+	case HealthCheckType_Handshake:
+	case HealthCheckType_URL:
+		if cfg.URL == "" {
+			return nil, errors.New("health check url must not empty")
+		}
+	default:
+		return nil, fmt.Errorf("unsupport health check type %q", cfg.Type)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHealthCheckTimeout
+	}
+	if cfg.UpThreshold <= 0 {
+		cfg.UpThreshold = DefaultHealthCheckUpThreshold
+	}
+	if cfg.DownThreshold <= 0 {
+		cfg.DownThreshold = DefaultHealthCheckDownThreshold
+	}
+	return &HealthChecker{
+		Name:   name,
+		Config: cfg,
+		probe:  probe,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (hc *HealthChecker) Start() {
+	if !hc.Config.Enabled() {
+		return
+	}
+	go func() {
+		hc.Check()
+		tk := time.NewTicker(hc.Config.Interval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				hc.Check()
+			case <-hc.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background checks
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() { close(hc.done) })
+}
+
+// Check runs the probe once and updates the state
+func (hc *HealthChecker) Check() HealthState {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Config.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := hc.probe(ctx)
+	if err == nil {
+		hc.updateLatency(time.Since(start))
+	}
+	return hc.report(err)
+}
+
+func (hc *HealthChecker) updateLatency(d time.Duration) {
+	old := hc.latency.Load()
+	if old == 0 {
+		hc.latency.Store(int64(d))
+		return
+	}
+	hc.latency.Store(int64(HealthCheckLatencyAlpha*float64(d) + (1-HealthCheckLatencyAlpha)*float64(old)))
+}
+
+// Latency returns the smoothed probe latency, 0 if not measured yet
+func (hc *HealthChecker) Latency() time.Duration {
+	return time.Duration(hc.latency.Load())
+}
+
+func (hc *HealthChecker) report(err error) HealthState {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	hc.lastCheck = time.Now()
+	hc.lastErr = err
+	old := hc.State()
+	state := old
+	if err == nil {
+		hc.failures = 0
+		hc.successes++
+		if hc.successes >= hc.Config.UpThreshold {
+			state = HealthState_Up
+		}
+	} else {
+		hc.successes = 0
+		hc.failures++
+		if hc.failures >= hc.Config.DownThreshold {
+			state = HealthState_Down
+		}
+		logger.With("server", hc.Name).Debugf("health check failed: %v", err)
+	}
+
+	if state != old {
+		hc.state.Store(int32(state))
+		l := logger.With("server", hc.Name)
+		if err != nil {
+			l.Warnf("server health %s -> %s, err: %v", old, state, err)
+		} else {
+			l.Infof("server health %s -> %s", old, state)
+		}
+	}
+	return state
+}
+
+func (hc *HealthChecker) State() HealthState {
+	return HealthState(hc.state.Load())
+}
+
+// LastCheck returns the time and error of the latest probe
+func (hc *HealthChecker) LastCheck() (time.Time, error) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	return hc.lastCheck, hc.lastErr
+}
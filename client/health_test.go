@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestURLProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var d net.Dialer
+	hc, err := NewHealthChecker("test", HealthCheckConfig{
+		Type:          HealthCheckType_URL,
+		URL:           srv.URL,
+		DownThreshold: 1,
+	}, NewURLProbe(srv.URL+"/generate_204", 0, d.DialContext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := hc.Check(); s != HealthState_Up {
+		t.Errorf("expect up, got %s", s)
+	}
+	if hc.Latency() <= 0 {
+		t.Error("expect latency measured")
+	}
+
+	hc.probe = NewURLProbe(srv.URL+"/fail", 0, d.DialContext)
+	if s := hc.Check(); s != HealthState_Down {
+		t.Errorf("expect down on 503, got %s", s)
+	}
+
+	// 204 is not the expected status
+	probe := NewURLProbe(srv.URL+"/generate_204", http.StatusOK, d.DialContext)
+	if err := probe(context.Background()); err == nil {
+		t.Error("expect unexpected status error")
+	}
+}
@@ -1,8 +1,10 @@
 package client
 
 import (
+	"net"
 	"net/http"
 
+	"github.com/mengseeker/nlink/core/socks"
 	"github.com/mengseeker/nlink/core/transform"
 )
 
@@ -42,7 +44,7 @@ func (h *HTTPHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 		Net:  "tcp",
 		Addr: r.URL.Host,
 	}
-	h.ruleMapper.Match(NewMatchMetaFromHTTPSHost(r.URL.Host)).Conn(proxyClient, &remote)
+	h.ruleMapper.Match(h.matchMeta(NewMatchMetaFromHTTPSRequest(r), r)).Conn(proxyClient, &remote)
 }
 
 func (h *HTTPHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
@@ -51,7 +53,16 @@ func (h *HTTPHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	deleteRequestHeaders(r)
-	h.ruleMapper.Match(NewMatchMetaFromHTTPRequest(r)).HTTPRequest(w, r)
+	h.ruleMapper.Match(h.matchMeta(NewMatchMetaFromHTTPRequest(r), r)).HTTPRequest(w, r)
+}
+
+// matchMeta fills the process of the client if needed
+func (h *HTTPHandler) matchMeta(mm MatchMeta, r *http.Request) MatchMeta {
+	if h.ruleMapper.NeedProcess() {
+		ip, port, _ := net.SplitHostPort(r.RemoteAddr)
+		mm.ProcessPath = findProcessPath(socks.TCP, net.ParseIP(ip), port)
+	}
+	return mm
 }
 
 func deleteRequestHeaders(req *http.Request) {
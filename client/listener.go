@@ -1,11 +1,13 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/mengseeker/nlink/core/socks/transport/socks4"
 	"github.com/mengseeker/nlink/core/socks/transport/socks5"
@@ -19,11 +21,28 @@ type Listener struct {
 	Socks5Handler SockesHandler
 	TunnelHandler any // TODO
 
-	lis         net.Listener
-	wg          sync.WaitGroup
-	httpConns   chan net.Conn
-	socks4Conns chan net.Conn
-	socks5Conns chan net.Conn
+	// max time Close waits for accepted connections, default is DefaultCloseTimeout
+	CloseTimeout time.Duration
+
+	lock       sync.Mutex
+	lis        net.Listener
+	closed     bool
+	done       chan struct{}
+	httpServer *http.Server
+	httpConns  chan net.Conn
+	// dispatching goroutines
+	wg sync.WaitGroup
+	// accepted connections not closed yet
+	conns   map[*trackedConn]struct{}
+	connsWG sync.WaitGroup
+}
+
+// init must be called with lock held
+func (l *Listener) init() {
+	if l.done == nil {
+		l.done = make(chan struct{})
+		l.conns = map[*trackedConn]struct{}{}
+	}
 }
 
 func (l *Listener) ListenAndServe() (err error) {
@@ -31,28 +50,22 @@ func (l *Listener) ListenAndServe() (err error) {
 	if err != nil {
 		return fmt.Errorf("listen address %s err: %s", l.Address, err)
 	}
+	l.lock.Lock()
+	l.init()
+	if l.closed {
+		l.lock.Unlock()
+		lis.Close()
+		return nil
+	}
 	l.lis = lis
-	defer lis.Close()
-	l.wg = sync.WaitGroup{}
-	defer l.wg.Wait()
 	if l.HTTPHandler != nil {
+		l.httpConns = make(chan net.Conn)
+		l.httpServer = &http.Server{Handler: l.HTTPHandler}
 		l.wg.Add(1)
-		l.httpConns = make(chan net.Conn, 1)
-		defer close(l.httpConns)
 		go l.handleHTTPServer()
 	}
-	if l.Socks4Handler != nil {
-		l.wg.Add(1)
-		l.socks4Conns = make(chan net.Conn, 1)
-		defer close(l.socks4Conns)
-		go l.handleSocks4()
-	}
-	if l.Socks5Handler != nil {
-		l.wg.Add(1)
-		l.socks5Conns = make(chan net.Conn, 1)
-		defer close(l.socks5Conns)
-		go l.handleSocks5()
-	}
+	l.lock.Unlock()
+	defer l.wg.Wait()
 
 	for {
 		conn, err := lis.Accept()
@@ -62,57 +75,140 @@ func (l *Listener) ListenAndServe() (err error) {
 			}
 			return err
 		}
-		go l.handleTCPConn(conn)
+		tc := l.track(conn)
+		if tc == nil {
+			conn.Close()
+			return nil
+		}
+		go l.handleTCPConn(tc)
 	}
 }
 
-func (l *Listener) handleSocks4() {
-	defer l.wg.Done()
-	for conn := range l.socks4Conns {
-		go l.Socks4Handler.HandleConn(conn)
+// Close stops accepting new connections and waits for accepted ones for
+// CloseTimeout, connections still open after that are closed.
+// ListenAndServe returns after the dispatching goroutines exit.
+func (l *Listener) Close() error {
+	l.lock.Lock()
+	l.init()
+	if l.closed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	lis, srv := l.lis, l.httpServer
+	l.lock.Unlock()
+
+	var errs []error
+	if lis != nil {
+		if err := lis.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
 	}
+	timeout := l.CloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if srv != nil {
+		// closes idle keep-alive conns and waits for in-flight requests
+		srv.Shutdown(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		l.connsWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		l.lock.Lock()
+		conns := make([]*trackedConn, 0, len(l.conns))
+		for c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.lock.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		errs = append(errs, fmt.Errorf("%d connections closed by close timeout", len(conns)))
+	}
+	return errors.Join(errs...)
 }
 
-func (l *Listener) handleSocks5() {
-	defer l.wg.Done()
-	for conn := range l.socks5Conns {
-		go l.Socks5Handler.HandleConn(conn)
+// track returns the tracked conn, nil if the listener is closed
+func (l *Listener) track(conn net.Conn) *trackedConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
 	}
+	tc := &trackedConn{Conn: conn, l: l}
+	l.conns[tc] = struct{}{}
+	l.connsWG.Add(1)
+	return tc
+}
+
+func (l *Listener) untrack(tc *trackedConn) {
+	l.lock.Lock()
+	delete(l.conns, tc)
+	l.lock.Unlock()
+	l.connsWG.Done()
+}
+
+// trackedConn is an accepted connection, removed from the listener
+// when closed
+type trackedConn struct {
+	net.Conn
+	l    *Listener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.l.untrack(c) })
+	return err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return transform.CloseWrite(c.Conn)
 }
 
 func (l *Listener) handleHTTPServer() {
 	defer l.wg.Done()
-	if l.HTTPHandler != nil {
-		err := http.Serve(&HTTPListener{l}, l.HTTPHandler)
-		if err != nil && !errors.Is(err, net.ErrClosed) {
-			logger.Errorf("unexpected server close: %v", err)
-		}
+	err := l.httpServer.Serve(&HTTPListener{l})
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorf("unexpected server close: %v", err)
 	}
 }
 
-func (l *Listener) handleTCPConn(conn net.Conn) {
-	defer func() {
-		recover()
-	}()
-	conn.(*net.TCPConn).SetKeepAlive(true)
+func (l *Listener) handleTCPConn(conn *trackedConn) {
+	if tcp, ok := conn.Conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+	}
 
 	bufConn := transform.NewPeekConn(conn)
 	head, err := bufConn.Peek(1)
 	if err != nil {
+		conn.Close()
 		return
 	}
 
-	switch head[0] {
-	case socks4.Version:
-		if l.socks4Conns != nil {
-			l.socks4Conns <- bufConn
-		}
-	case socks5.Version:
-		if l.socks5Conns != nil {
-			l.socks5Conns <- bufConn
+	switch {
+	case head[0] == socks4.Version && l.Socks4Handler != nil:
+		l.Socks4Handler.HandleConn(bufConn)
+	case head[0] == socks5.Version && l.Socks5Handler != nil:
+		l.Socks5Handler.HandleConn(bufConn)
+	case l.httpConns != nil:
+		select {
+		case l.httpConns <- bufConn:
+		case <-l.done:
+			conn.Close()
 		}
 	default:
-		l.httpConns <- bufConn
+		conn.Close()
 	}
 }
 
@@ -121,11 +217,12 @@ type HTTPListener struct {
 }
 
 func (l *HTTPListener) Accept() (net.Conn, error) {
-	c, exist := <-l.httpConns
-	if !exist {
+	select {
+	case c := <-l.httpConns:
+		return c, nil
+	case <-l.done:
 		return nil, net.ErrClosed
 	}
-	return c, nil
 }
 
 func (l *HTTPListener) Close() error {
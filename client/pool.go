@@ -1,7 +1,12 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mengseeker/nlink/core/transform"
@@ -36,18 +41,27 @@ type Conn interface {
 // use for http proxy client
 type httpConn struct {
 	Conn
-	pl *ConnPool
+	pl     *ConnPool
+	closed atomic.Bool
+	// called once before the stream is put back
+	onClose func()
 }
 
 func (hc *httpConn) Close() error {
+	if !hc.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 	hc.Conn.Close()
+	if hc.onClose != nil {
+		hc.onClose()
+	}
 	hc.pl.Put(hc.Conn)
 	return nil
 }
 
 type ConnPool struct {
 	// Dialer is used to create a new connection to server
-	Dialer func() (Conn, error)
+	Dialer func(ctx context.Context) (Conn, error)
 
 	// max conns
 	MaxConns int
@@ -58,20 +72,96 @@ type ConnPool struct {
 	// conn timeout and remove from pool
 	IdleTimeout time.Duration
 
+	// idle conns dialed in advance, not more than MaxIdle
+	MinIdle int
+
+	// max time waiting for a conn when MaxConns is reached
+	WaitTimeout time.Duration
+
 	conns   chan Conn
 	putChan chan *putBackConn
 
-	// disconnectNum int
-	// dialServerNum int
-	// dialRemoteNum int
-	// recoverNum    int
+	// a slot is held by every conn dialed to server until disconnected
+	sem chan struct{}
+	// notify to dial MinIdle conns
+	fill chan struct{}
+
+	// canceled when the pool is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// background goroutines
+	bg sync.WaitGroup
+	// closed is guarded by lock, conns are never put back after closed
+	lock   sync.RWMutex
+	closed bool
+	// conns returned by DialRemote and not put back yet
+	activeConns sync.Map
+	// closed when no stream is active after the pool is closed
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	// streams bound to remote and not put back yet
+	active atomic.Int64
+	// conns waiting in the pool
+	idle atomic.Int64
+
+	stats poolCounters
+}
+
+type poolCounters struct {
+	dials        atomic.Int64
+	dialFailures atomic.Int64
+	dialRemotes  atomic.Int64
+	reuses       atomic.Int64
+	resets       atomic.Int64
+	waits        atomic.Int64
+	waitTimeouts atomic.Int64
+	waitTime     atomic.Int64
+
+	lock        sync.Mutex
+	disconnects map[string]int64
+}
+
+// PoolStats is a snapshot of the pool counters
+type PoolStats struct {
+	// conns dialed to server
+	Dials        int64
+	DialFailures int64
+	// streams bound to remote
+	DialRemotes int64
+	// streams served by idle conns
+	Reuses int64
+	// conns reset and put back to the pool
+	Resets int64
+	// disconnected conns by reason
+	Disconnects map[string]int64
+
+	Idle   int
+	Active int
+
+	// gets waited for a conn because MaxConns is reached
+	Waits        int64
+	WaitTimeouts int64
+	WaitTime     time.Duration
 }
 
 const (
 	DefaultMaxConns    = 200
 	DefaultIdleTimeout = 10 * time.Minute
 	// DefaultIdleTimeout = 10 * time.Second
-	DefaultMaxIdle = 3
+	DefaultMaxIdle     = 3
+	DefaultWaitTimeout = 5 * time.Second
+
+	// max time Close waits for active streams
+	DefaultCloseTimeout = 5 * time.Second
+
+	// retry interval of dialing MinIdle conns
+	fillIdleInterval = 10 * time.Second
+)
+
+var (
+	ErrPoolExhausted = errors.New("pool exhausted")
+	ErrPoolClosed    = errors.New("pool closed")
 )
 
 type PoolConfig struct {
@@ -80,7 +170,7 @@ type PoolConfig struct {
 	MaxIdle     int
 }
 
-func NewConnPool(cfg ServerConfig, dialer func() (Conn, error)) *ConnPool {
+func NewConnPool(cfg ServerConfig, dialer func(ctx context.Context) (Conn, error)) *ConnPool {
 	if cfg.MaxConns == 0 {
 		cfg.MaxConns = DefaultMaxConns
 	}
@@ -90,38 +180,187 @@ func NewConnPool(cfg ServerConfig, dialer func() (Conn, error)) *ConnPool {
 	if cfg.MaxIdle < 0 {
 		cfg.MaxIdle = DefaultMaxIdle
 	}
+	if cfg.MinIdle > cfg.MaxIdle {
+		cfg.MinIdle = cfg.MaxIdle
+	}
+	if cfg.WaitTimeout == 0 {
+		cfg.WaitTimeout = DefaultWaitTimeout
+	}
 
 	pl := &ConnPool{
 		MaxConns:    cfg.MaxConns,
+		MaxIdle:     cfg.MaxIdle,
+		MinIdle:     cfg.MinIdle,
 		IdleTimeout: cfg.IdleTimeout,
+		WaitTimeout: cfg.WaitTimeout,
 		conns:       make(chan Conn, cfg.MaxIdle),
-		putChan:     make(chan *putBackConn, DefaultMaxConns),
+		putChan:     make(chan *putBackConn, cfg.MaxConns),
+		sem:         make(chan struct{}, cfg.MaxConns),
+		fill:        make(chan struct{}, 1),
+		drained:     make(chan struct{}),
 	}
+	pl.ctx, pl.cancel = context.WithCancel(context.Background())
 
-	pl.Dialer = func() (Conn, error) {
-		// pl.dialServerNum++
-		return dialer()
+	pl.Dialer = func(ctx context.Context) (Conn, error) {
+		pl.stats.dials.Add(1)
+		conn, err := dialer(ctx)
+		if err != nil {
+			pl.stats.dialFailures.Add(1)
+		}
+		return conn, err
 	}
 
+	pl.bg.Add(1)
 	go pl.handlePut()
+	if pl.MinIdle > 0 {
+		pl.bg.Add(1)
+		go pl.handleFill()
+	}
 	return pl
 }
 
+// ConnCount returns the number of active streams,
+// a stream is active from DialRemote until it is put back.
 func (p *ConnPool) ConnCount() int {
-	return len(p.putChan)
+	return int(p.active.Load())
+}
+
+// IdleCount returns the number of idle conns in the pool
+func (p *ConnPool) IdleCount() int {
+	return int(p.idle.Load())
 }
 
-func (p *ConnPool) get() (Conn, error) {
+func (p *ConnPool) Stats() PoolStats {
+	st := PoolStats{
+		Dials:        p.stats.dials.Load(),
+		DialFailures: p.stats.dialFailures.Load(),
+		DialRemotes:  p.stats.dialRemotes.Load(),
+		Reuses:       p.stats.reuses.Load(),
+		Resets:       p.stats.resets.Load(),
+		Disconnects:  map[string]int64{},
+		Idle:         p.IdleCount(),
+		Active:       p.ConnCount(),
+		Waits:        p.stats.waits.Load(),
+		WaitTimeouts: p.stats.waitTimeouts.Load(),
+		WaitTime:     time.Duration(p.stats.waitTime.Load()),
+	}
+	p.stats.lock.Lock()
+	for reason, n := range p.stats.disconnects {
+		st.Disconnects[reason] = n
+	}
+	p.stats.lock.Unlock()
+	return st
+}
+
+// get returns an idle conn or dials a new one, waits WaitTimeout for
+// an idle conn or a free slot if MaxConns is reached.
+func (p *ConnPool) get(ctx context.Context) (Conn, error) {
+	if p.ctx.Err() != nil {
+		return nil, ErrPoolClosed
+	}
 	select {
 	case conn := <-p.conns:
+		p.gotIdle()
 		return conn, nil
 	default:
-		return p.Dialer()
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		return p.dial(ctx)
+	default:
+	}
+
+	p.stats.waits.Add(1)
+	start := time.Now()
+	defer func() {
+		p.stats.waitTime.Add(int64(time.Since(start)))
+	}()
+	tm := time.NewTimer(p.WaitTimeout)
+	defer tm.Stop()
+	select {
+	case conn := <-p.conns:
+		p.gotIdle()
+		return conn, nil
+	case p.sem <- struct{}{}:
+		return p.dial(ctx)
+	case <-tm.C:
+		p.stats.waitTimeouts.Add(1)
+		return nil, fmt.Errorf("%w: %d conns in use, waited %s", ErrPoolExhausted, p.MaxConns, p.WaitTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.ctx.Done():
+		return nil, ErrPoolClosed
+	}
+}
+
+func (p *ConnPool) gotIdle() {
+	p.idle.Add(-1)
+	p.stats.reuses.Add(1)
+	if p.MinIdle > 0 {
+		select {
+		case p.fill <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dial dials a new conn, the slot must be acquired before
+func (p *ConnPool) dial(ctx context.Context) (Conn, error) {
+	conn, err := p.Dialer(ctx)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handleFill keeps MinIdle conns in the pool, so the first request
+// after startup or idle timeout is not blocked by tls handshake.
+func (p *ConnPool) handleFill() {
+	defer p.bg.Done()
+	tk := time.NewTicker(fillIdleInterval)
+	defer tk.Stop()
+	for {
+		p.fillIdle()
+		select {
+		case <-tk.C:
+		case <-p.fill:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *ConnPool) fillIdle() {
+	for p.IdleCount() < p.MinIdle {
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			// all slots are in use
+			return
+		}
+		conn, err := p.dial(p.ctx)
+		if err != nil {
+			if p.ctx.Err() == nil {
+				logger.Warnf("dial idle conn err: %v", err)
+			}
+			return
+		}
+		if !p.putIdle(conn) {
+			return
+		}
 	}
 }
 
 func (p *ConnPool) DialRemote(remote *transform.Meta) (Conn, error) {
-	conn, err := p.get()
+	return p.DialRemoteContext(context.Background(), remote)
+}
+
+// DialRemoteContext binds a conn to remote, ctx limits the time of
+// dialing a new conn to server.
+func (p *ConnPool) DialRemoteContext(ctx context.Context, remote *transform.Meta) (Conn, error) {
+	conn, err := p.get(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -130,17 +369,18 @@ func (p *ConnPool) DialRemote(remote *transform.Meta) (Conn, error) {
 		return nil, err
 	}
 
-	// p.dialRemoteNum++
+	p.active.Add(1)
+	p.activeConns.Store(conn, struct{}{})
+	p.stats.dialRemotes.Add(1)
 	logger.Infof("proxy to %s", remote.String())
 
-	// logger.With(
-	// 	zap.Int("idle_conn", len(p.putChan)),
-	// 	zap.Int("dial_remote", p.dialRemoteNum),
-	// 	zap.Int("dial_server", p.dialServerNum),
-	// 	zap.Int("recover", p.recoverNum),
-	// 	zap.Int("disconnect", p.disconnectNum),
-	// 	zap.Int("used_conn", p.dialServerNum-p.disconnectNum),
-	// ).Debug("dial status")
+	logger.With(
+		"idle_conn", p.IdleCount(),
+		"active_conn", p.ConnCount(),
+		"dial_remote", p.stats.dialRemotes.Load(),
+		"dial_server", p.stats.dials.Load(),
+		"reuse", p.stats.reuses.Load(),
+	).Debug("dial status")
 	return conn, err
 }
 
@@ -150,43 +390,144 @@ type putBackConn struct {
 }
 
 func (p *ConnPool) handlePut() {
-	tm := time.NewTimer(p.IdleTimeout)
-	var leftTime time.Duration
+	defer p.bg.Done()
 	for {
-		conn := <-p.putChan
-		leftTime = time.Until(conn.lastUse.Add(p.IdleTimeout))
+		var conn *putBackConn
+		select {
+		case conn = <-p.putChan:
+		case <-p.ctx.Done():
+			return
+		}
+		leftTime := time.Until(conn.lastUse.Add(p.IdleTimeout))
 		if leftTime <= time.Second {
+			p.idle.Add(-1)
 			p.DisconnectConn(conn.conn, "idle timeout")
 			continue
 		}
 
-		tm.Reset(leftTime)
-
+		tm := time.NewTimer(leftTime)
 		select {
 		case p.conns <- conn.conn:
-			continue
 		case <-tm.C:
+			p.idle.Add(-1)
 			p.DisconnectConn(conn.conn, "idle timeout")
+		case <-p.ctx.Done():
+			p.idle.Add(-1)
+			p.DisconnectConn(conn.conn, "pool closed")
 		}
+		tm.Stop()
 	}
 }
 
+// Put puts back a conn returned by DialRemote
 func (p *ConnPool) Put(conn Conn) {
-	// p.recoverNum++
+	if _, ok := p.activeConns.LoadAndDelete(conn); !ok {
+		// put twice or disconnected by Close
+		return
+	}
+	if p.active.Add(-1) == 0 {
+		p.lock.RLock()
+		closed := p.closed
+		p.lock.RUnlock()
+		if closed {
+			p.drainedOnce.Do(func() { close(p.drained) })
+		}
+	}
 	if err := conn.Reset(); err != nil {
 		p.DisconnectConn(conn, "reset error")
 		return
 	}
+	p.stats.resets.Add(1)
+	p.putIdle(conn)
+}
 
+// putIdle puts conn to the idle queue, returns false if the conn is
+// disconnected because the pool is full or closed.
+func (p *ConnPool) putIdle(conn Conn) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		p.DisconnectConn(conn, "pool closed")
+		return false
+	}
+	p.idle.Add(1)
 	select {
 	case p.putChan <- &putBackConn{conn: conn, lastUse: time.Now()}:
-		return
+		return true
 	default:
+		p.idle.Add(-1)
 		p.DisconnectConn(conn, "pool is full")
+		return false
+	}
+}
+
+// Close stops background goroutines, disconnects idle conns and waits
+// active streams for DefaultCloseTimeout, streams still active after
+// that are disconnected.
+func (p *ConnPool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	p.cancel()
+	p.bg.Wait()
+	p.disconnectIdle()
+
+	// streams put back after closed is set close drained
+	if p.ConnCount() == 0 {
+		p.drainedOnce.Do(func() { close(p.drained) })
+	}
+	tm := time.NewTimer(DefaultCloseTimeout)
+	select {
+	case <-p.drained:
+	case <-tm.C:
+	}
+	tm.Stop()
+	n := 0
+	p.activeConns.Range(func(key, _ any) bool {
+		if _, ok := p.activeConns.LoadAndDelete(key); ok {
+			p.active.Add(-1)
+			p.DisconnectConn(key.(Conn), "pool closed")
+			n++
+		}
+		return true
+	})
+	if n > 0 {
+		return fmt.Errorf("%d active streams disconnected by close timeout", n)
 	}
+	return nil
 }
 
+func (p *ConnPool) disconnectIdle() {
+	for {
+		select {
+		case conn := <-p.conns:
+			p.idle.Add(-1)
+			p.DisconnectConn(conn, "pool closed")
+		case conn := <-p.putChan:
+			p.idle.Add(-1)
+			p.DisconnectConn(conn.conn, "pool closed")
+		default:
+			return
+		}
+	}
+}
+
+// DisconnectConn disconnects a conn dialed by the pool and frees its slot
 func (p *ConnPool) DisconnectConn(conn Conn, reason string) {
-	// p.disconnectNum++
+	p.stats.lock.Lock()
+	if p.stats.disconnects == nil {
+		p.stats.disconnects = map[string]int64{}
+	}
+	p.stats.disconnects[reason]++
+	p.stats.lock.Unlock()
 	conn.Disconnect(reason)
+	select {
+	case <-p.sem:
+	default:
+	}
 }
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+// fakeConn is a Conn doing nothing, only the pool methods are usable
+type fakeConn struct {
+	net.Conn
+	disconnected atomic.Bool
+}
+
+func (c *fakeConn) Close() error                   { return nil }
+func (c *fakeConn) CloseWrite() error              { return nil }
+func (c *fakeConn) Bind(*transform.Meta) error     { return nil }
+func (c *fakeConn) Reset() error                   { return nil }
+func (c *fakeConn) Disconnect(reason string) error { c.disconnected.Store(true); return nil }
+
+func newTestPool(cfg ServerConfig) *ConnPool {
+	return NewConnPool(cfg, func(ctx context.Context) (Conn, error) {
+		return &fakeConn{}, nil
+	})
+}
+
+var testRemote = &transform.Meta{Net: "tcp", Addr: "example.com:80"}
+
+// waitFor polls cond until it is true or a second passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnPoolMaxConnsWait(t *testing.T) {
+	p := newTestPool(ServerConfig{MaxConns: 1, MaxIdle: 1, WaitTimeout: time.Second})
+	defer p.Close()
+
+	first, err := p.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan Conn)
+	go func() {
+		conn, err := p.DialRemote(testRemote)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- conn
+	}()
+	select {
+	case <-got:
+		t.Fatal("expect blocked at MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Put(first)
+	conn := <-got
+	if conn != first {
+		t.Error("expect the put back conn reused")
+	}
+	p.Put(conn)
+	if st := p.Stats(); st.Dials != 1 || st.Waits != 1 || st.Reuses != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestConnPoolWaitTimeout(t *testing.T) {
+	p := newTestPool(ServerConfig{MaxConns: 1, WaitTimeout: 20 * time.Millisecond})
+	defer p.Close()
+
+	conn, err := p.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(conn)
+	if _, err := p.DialRemote(testRemote); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("expect pool exhausted, got %v", err)
+	}
+	if st := p.Stats(); st.WaitTimeouts != 1 {
+		t.Errorf("expect 1 wait timeout, got %+v", st)
+	}
+}
+
+func TestConnPoolMinIdle(t *testing.T) {
+	p := newTestPool(ServerConfig{MaxConns: 10, MaxIdle: 2, MinIdle: 1})
+	defer p.Close()
+
+	waitFor(t, func() bool { return p.IdleCount() == 1 })
+	conn, err := p.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(conn)
+	// taking the idle conn triggers a refill
+	waitFor(t, func() bool { return p.IdleCount() == 1 })
+	if st := p.Stats(); st.Dials != 2 || st.Reuses != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestConnPoolActiveCount(t *testing.T) {
+	p := newTestPool(ServerConfig{})
+	defer p.Close()
+
+	a, err := p.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.DialRemote(testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.ConnCount(); n != 2 {
+		t.Fatalf("expect 2 active streams, got %d", n)
+	}
+	p.Put(a)
+	if n := p.ConnCount(); n != 1 {
+		t.Fatalf("expect 1 active stream, got %d", n)
+	}
+	// put twice is ignored
+	p.Put(a)
+	if n := p.ConnCount(); n != 1 {
+		t.Fatalf("expect 1 active stream after double put, got %d", n)
+	}
+	p.Put(b)
+	if n := p.ConnCount(); n != 0 {
+		t.Fatalf("expect no active stream, got %d", n)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/mengseeker/nlink/core/geoip"
+	"github.com/mengseeker/nlink/core/process"
 	"github.com/mengseeker/nlink/core/socks"
 )
 
@@ -24,8 +27,26 @@ const (
 	RuleCondType_IPCIDR     RuleCondType = "ip-cidr"
 	RuleCondType_HasServer  RuleCondType = "has-server"
 	RuleCondType_MatchAll   RuleCondType = "match-all"
+	RuleCondType_RuleSet    RuleCondType = "rule-set"
+	RuleCondType_GeoSite    RuleCondType = "geosite"
+	RuleCondType_IPASN      RuleCondType = "ip-asn"
+	RuleCondType_DstPort    RuleCondType = "dst-port"
+	RuleCondType_SrcIPCIDR  RuleCondType = "src-ip-cidr"
+	RuleCondType_Inbound    RuleCondType = "inbound"
+	RuleCondType_Network    RuleCondType = "network"
+	// linux only
+	RuleCondType_ProcessName RuleCondType = "process-name"
+	RuleCondType_ProcessPath RuleCondType = "process-path"
 )
 
+// params of inbound condition
+var inboundTypes = map[string]socks.Type{
+	"http":          socks.HTTP,
+	"https-connect": socks.HTTPCONNECT,
+	"socks4":        socks.SOCKS4,
+	"socks5":        socks.SOCKS5,
+}
+
 type RuleActionType string
 
 const (
@@ -45,59 +66,48 @@ type RuleAction struct {
 }
 
 type Rule struct {
-	Conds []RuleCond
+	Expr *RuleExpr
 	RuleAction
 }
 
+// Conds returns all conditions of the rule
+func (r Rule) Conds() []RuleCond {
+	return r.Expr.Conds()
+}
+
 var (
 	ErrInvalidSyntax = errors.New("invalid syntax")
 )
 
+// UnmashalProxyRule parses rule "expression, action[: param]", see RuleExpr
+// for the expression syntax.
 func UnmashalProxyRule(raw string) (r Rule, err error) {
-	rs := strings.Split(raw, ",")
-	if len(rs) != 2 {
-		err = ErrInvalidSyntax
+	i := strings.LastIndex(raw, ",")
+	if i < 0 {
+		err = &RuleSyntaxError{Rule: raw, Column: len(raw) + 1, Msg: "missing action"}
 		return
 	}
-	conds := strings.Split(rs[0], "&&")
-	for _, v := range conds {
-		cond := RuleCond{}
-		condStr := strings.SplitN(v, ":", 2)
-		cond.Cond = RuleCondType(strings.TrimSpace(strings.ToLower(condStr[0])))
-		if len(condStr) > 1 {
-			cond.CondParam = strings.TrimSpace(condStr[1])
-		}
-		r.Conds = append(r.Conds, cond)
+	r.Expr, err = ParseRuleExpr(raw, raw[:i], 0)
+	if err != nil {
+		return
 	}
 
-	actionStr := strings.SplitN(rs[1], ":", 2)
+	actionStr := strings.SplitN(raw[i+1:], ":", 2)
 	r.Action = RuleActionType(strings.TrimSpace(strings.ToLower(actionStr[0])))
+	if r.Action == "" {
+		err = &RuleSyntaxError{Rule: raw, Column: i + 2, Msg: "missing action"}
+		return
+	}
 	if len(actionStr) > 1 {
 		r.ActionParam = strings.TrimSpace(actionStr[1])
 	}
 	return r, nil
 }
 
-func (r Rule) Check(forwards map[string]Forward) error {
-	for _, c := range r.Conds {
-		switch c.Cond {
-		case RuleCondType_HostMatch, RuleCondType_HostPrefix, RuleCondType_HostSuffix, RuleCondType_GEOIP, RuleCondType_HasServer:
-			if c.CondParam == "" {
-				return fmt.Errorf("rule condition %q params must not empty", c.Cond)
-			}
-		case RuleCondType_HostRegexp:
-			_, err := regexp.Compile(c.CondParam)
-			if err != nil {
-				return fmt.Errorf("rule condition %q params must a valid regexp, compile err: %v", c.Cond, err)
-			}
-		case RuleCondType_IPCIDR:
-			_, _, err := net.ParseCIDR(c.CondParam)
-			if err != nil {
-				return fmt.Errorf("rule condition %q params must a valid IPCIDR, parse err: %v", c.Cond, err)
-			}
-		case RuleCondType_MatchAll:
-		default:
-			return fmt.Errorf("unsupport rule condition %q", c.Cond)
+func (r Rule) Check(pv *FuncProvider, forwards map[string]Forward) error {
+	for _, c := range r.Conds() {
+		if err := c.Check(pv); err != nil {
+			return err
 		}
 	}
 
@@ -114,10 +124,114 @@ func (r Rule) Check(forwards map[string]Forward) error {
 	return nil
 }
 
+// NeedResolve reports whether matching the condition resolves the host, a
+// rule set resolves it only if the set has CIDR entries
+func (c RuleCond) NeedResolve(pv *FuncProvider) bool {
+	switch c.Cond {
+	case RuleCondType_GEOIP, RuleCondType_IPCIDR, RuleCondType_IPASN:
+		return true
+	case RuleCondType_RuleSet:
+		p := pv.RuleProvider(c.CondParam)
+		return p != nil && p.RuleSet().HasCIDR()
+	}
+	return false
+}
+
+func (c RuleCond) Check(pv *FuncProvider) error {
+	switch c.Cond {
+	case RuleCondType_GeoSite:
+		if _, err := pv.geoSiteCategory(c.CondParam); err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+	case RuleCondType_RuleSet:
+		if pv.RuleProvider(c.CondParam) == nil {
+			return fmt.Errorf("rule condition %q params must in rule providers", c.Cond)
+		}
+	case RuleCondType_GEOIP:
+		country, _, err := splitIPMatchMode(c.CondParam)
+		if err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+		if country == "" {
+			return fmt.Errorf("rule condition %q params must not empty", c.Cond)
+		}
+		if _, err := pv.GeoIP(); err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+	case RuleCondType_IPASN:
+		asn, _, err := splitIPMatchMode(c.CondParam)
+		if err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+		if _, err := parseASN(asn); err != nil {
+			return fmt.Errorf("rule condition %q params must an AS number, parse err: %v", c.Cond, err)
+		}
+		db, err := pv.GeoIP()
+		if err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+		if !db.HasASN() {
+			return fmt.Errorf("rule condition %q %v", c.Cond, geoip.ErrNoASNDB)
+		}
+	case RuleCondType_HostMatch, RuleCondType_HostPrefix, RuleCondType_HostSuffix, RuleCondType_HasServer,
+		RuleCondType_ProcessName, RuleCondType_ProcessPath:
+		if c.CondParam == "" {
+			return fmt.Errorf("rule condition %q params must not empty", c.Cond)
+		}
+	case RuleCondType_HostRegexp:
+		_, err := regexp.Compile(c.CondParam)
+		if err != nil {
+			return fmt.Errorf("rule condition %q params must a valid regexp, compile err: %v", c.Cond, err)
+		}
+	case RuleCondType_IPCIDR:
+		cidr, _, err := splitIPMatchMode(c.CondParam)
+		if err != nil {
+			return fmt.Errorf("rule condition %q %v", c.Cond, err)
+		}
+		_, _, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("rule condition %q params must a valid IPCIDR, parse err: %v", c.Cond, err)
+		}
+	case RuleCondType_SrcIPCIDR:
+		_, _, err := net.ParseCIDR(c.CondParam)
+		if err != nil {
+			return fmt.Errorf("rule condition %q params must a valid IPCIDR, parse err: %v", c.Cond, err)
+		}
+	case RuleCondType_DstPort:
+		if _, _, err := parsePortRange(c.CondParam); err != nil {
+			return fmt.Errorf("rule condition %q params must a port or port range, parse err: %v", c.Cond, err)
+		}
+	case RuleCondType_Inbound:
+		if _, ok := inboundTypes[strings.ToLower(c.CondParam)]; !ok {
+			return fmt.Errorf("rule condition %q params must one of http, https-connect, socks4, socks5", c.Cond)
+		}
+	case RuleCondType_Network:
+		// udp associate is not supported yet, udp never matches proxied
+		// traffic but can be explained
+		switch strings.ToLower(c.CondParam) {
+		case "tcp", "udp":
+		default:
+			return fmt.Errorf("rule condition %q params must tcp or udp", c.Cond)
+		}
+	case RuleCondType_MatchAll:
+	default:
+		return fmt.Errorf("unsupport rule condition %q", c.Cond)
+	}
+	return nil
+}
+
 type MatchMeta struct {
 	Schema string
 	Host   string
 	Port   string
+
+	Network socks.NetWork
+	Inbound socks.Type
+	// client IP, empty if unknown
+	SrcIP string
+	// executable of the local client process, only filled if
+	// RuleMapper.NeedProcess
+	ProcessPath string
 }
 
 func NewMatchMetaFromHTTPRequest(req *http.Request) MatchMeta {
@@ -126,49 +240,131 @@ func NewMatchMetaFromHTTPRequest(req *http.Request) MatchMeta {
 		port = "80"
 	}
 	return MatchMeta{
-		Schema: "http",
-		Host:   domain,
-		Port:   port,
+		Schema:  "http",
+		Host:    domain,
+		Port:    port,
+		Network: socks.TCP,
+		Inbound: socks.HTTP,
+		SrcIP:   remoteIP(req.RemoteAddr),
 	}
 }
 
-func NewMatchMetaFromHTTPSHost(host string) MatchMeta {
-	domain, port := ParseHost(host)
+func NewMatchMetaFromHTTPSRequest(req *http.Request) MatchMeta {
+	domain, port := ParseHost(req.URL.Host)
 	if port == "" {
 		port = "443"
 	}
 	return MatchMeta{
-		Schema: "https",
-		Host:   domain,
-		Port:   port,
+		Schema:  "https",
+		Host:    domain,
+		Port:    port,
+		Network: socks.TCP,
+		Inbound: socks.HTTPCONNECT,
+		SrcIP:   remoteIP(req.RemoteAddr),
 	}
 }
 
 func NewMatchMetaFromSocksMeta(meta *socks.Metadata) MatchMeta {
-	return MatchMeta{
-		Schema: "tcp",
-		Host:   meta.String(),
-		Port:   meta.DstPort,
+	mm := MatchMeta{
+		Schema:  "tcp",
+		Host:    meta.String(),
+		Port:    meta.DstPort,
+		Network: meta.NetWork,
+		Inbound: meta.Type,
+
+		ProcessPath: meta.ProcessPath,
 	}
+	if meta.SrcIP != nil {
+		mm.SrcIP = meta.SrcIP.String()
+	}
+	return mm
 }
 
-func (rm *RuleMapper) Match(meta MatchMeta) RuleHandler {
-	rm.lock.RLock()
-	if h, exist := rm.cache[meta]; exist {
-		rm.lock.RUnlock()
-		return h
+// remoteIP returns the IP of address "ip:port"
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// findProcessPath returns the executable of the local process owning the
+// connection from srcIP:srcPort, empty if not found
+func findProcessPath(network socks.NetWork, srcIP net.IP, srcPort string) string {
+	port, err := strconv.Atoi(srcPort)
+	if err != nil || srcIP == nil {
+		return ""
+	}
+	path, err := process.FindProcessPath(network.String(), srcIP, port)
+	if err != nil {
+		logger.Debugf("find process of %s err: %v", net.JoinHostPort(srcIP.String(), srcPort), err)
+		return ""
+	}
+	return path
+}
+
+// splitIPMatchMode splits param "value[@any|@all]" of conditions on resolved
+// addresses, the condition matches if any address matches by default, or
+// if all addresses match with @all.
+func splitIPMatchMode(param string) (value string, all bool, err error) {
+	value, mode, _ := strings.Cut(param, "@")
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "any":
+	case "all":
+		all = true
+	default:
+		err = fmt.Errorf("match mode must any or all, got %q", mode)
 	}
-	rm.lock.RUnlock()
-	for i := range rm.matchs {
-		if rm.matchs[i](meta) {
-			h := rm.actions[i]
-			rm.lock.Lock()
-			rm.cache[meta] = h
-			rm.lock.Unlock()
-			return h
+	return strings.TrimSpace(value), all, err
+}
+
+func matchIPs(ips []net.IP, all bool, match func(ip net.IP) bool) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if match(ip) != all {
+			// any: found a match, all: found a mismatch
+			return !all
+		}
+	}
+	return all
+}
+
+// parseASN parses "13335" or "AS13335"
+func parseASN(s string) (uint, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "as") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("AS number must not be 0")
+	}
+	return uint(n), nil
+}
+
+// parsePortRange parses "443" or "8000-9000"
+func parsePortRange(s string) (from, to int, err error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	from, err = strconv.Atoi(strings.TrimSpace(fromStr))
+	if err != nil {
+		return
+	}
+	to = from
+	if isRange {
+		to, err = strconv.Atoi(strings.TrimSpace(toStr))
+		if err != nil {
+			return
 		}
 	}
-	return &DirectRuleHandler{}
+	if from < 0 || to > 65535 || from > to {
+		err = fmt.Errorf("invalid port range %q", s)
+	}
+	return
 }
 
 func (r RuleCond) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
@@ -183,7 +379,7 @@ func (r RuleCond) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
 		}
 	case RuleCondType_HostSuffix:
 		return func(mm MatchMeta) bool {
-			return strings.HasSuffix(mm.Host, r.CondParam)
+			return MatchDomainSuffix(mm.Host, r.CondParam)
 		}
 	case RuleCondType_HostRegexp:
 		reg := regexp.MustCompile(r.CondParam)
@@ -191,13 +387,17 @@ func (r RuleCond) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
 			return reg.Match([]byte(mm.Host))
 		}
 	case RuleCondType_GEOIP:
+		country, all, _ := splitIPMatchMode(r.CondParam)
 		return func(mm MatchMeta) bool {
-			return pv.GEOIP(pv.Resolv(mm.Host)) == string(r.CondParam)
+			return matchIPs(pv.Resolv(mm.Host), all, func(ip net.IP) bool {
+				return pv.GEOIP(ip) == country
+			})
 		}
 	case RuleCondType_IPCIDR:
-		_, ipnet, _ := net.ParseCIDR(r.CondParam)
+		cidr, all, _ := splitIPMatchMode(r.CondParam)
+		_, ipnet, _ := net.ParseCIDR(cidr)
 		return func(mm MatchMeta) bool {
-			return ipnet.Contains(pv.Resolv(mm.Host))
+			return matchIPs(pv.Resolv(mm.Host), all, ipnet.Contains)
 		}
 	case RuleCondType_HasServer:
 		ok := pv.HasServer(r.CondParam)
@@ -206,24 +406,77 @@ func (r RuleCond) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
 		}
 	case RuleCondType_MatchAll:
 		return func(mm MatchMeta) bool { return true }
+	case RuleCondType_DstPort:
+		from, to, _ := parsePortRange(r.CondParam)
+		return func(mm MatchMeta) bool {
+			port, err := strconv.Atoi(mm.Port)
+			return err == nil && port >= from && port <= to
+		}
+	case RuleCondType_SrcIPCIDR:
+		_, ipnet, _ := net.ParseCIDR(r.CondParam)
+		return func(mm MatchMeta) bool {
+			return ipnet.Contains(net.ParseIP(mm.SrcIP))
+		}
+	case RuleCondType_Inbound:
+		inbound := inboundTypes[strings.ToLower(r.CondParam)]
+		return func(mm MatchMeta) bool {
+			return mm.Inbound == inbound
+		}
+	case RuleCondType_Network:
+		network := strings.ToLower(r.CondParam)
+		return func(mm MatchMeta) bool {
+			return mm.Network.String() == network
+		}
+	case RuleCondType_ProcessName:
+		return func(mm MatchMeta) bool {
+			return mm.ProcessPath != "" && filepath.Base(mm.ProcessPath) == r.CondParam
+		}
+	case RuleCondType_ProcessPath:
+		return func(mm MatchMeta) bool {
+			return mm.ProcessPath == r.CondParam
+		}
+	case RuleCondType_IPASN:
+		param, all, _ := splitIPMatchMode(r.CondParam)
+		asn, _ := parseASN(param)
+		return func(mm MatchMeta) bool {
+			return matchIPs(pv.Resolv(mm.Host), all, func(ip net.IP) bool {
+				return pv.ASN(ip) == asn
+			})
+		}
+	case RuleCondType_GeoSite:
+		category, err := pv.geoSiteCategory(r.CondParam)
+		if err != nil {
+			return func(mm MatchMeta) bool { return false }
+		}
+		// built on first match, rules merged into a domainRuleBlock rarely
+		// need it
+		var once sync.Once
+		var m *domainMatcher
+		return func(mm MatchMeta) bool {
+			once.Do(func() {
+				m = newDomainMatcher()
+				m.Add(category, 0)
+				m.Build()
+			})
+			return m.Match(mm.Host)
+		}
+	case RuleCondType_RuleSet:
+		p := pv.RuleProvider(r.CondParam)
+		return func(mm MatchMeta) bool {
+			// load the set on every match, it is swapped on reload
+			set := p.RuleSet()
+			if set.MatchDomain(mm.Host) {
+				return true
+			}
+			return set.HasCIDR() && matchIPs(pv.Resolv(mm.Host), false, set.MatchIP)
+		}
 	default:
 		return func(mm MatchMeta) bool { return false }
 	}
 }
 
 func (r Rule) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
-	funcs := []func(mm MatchMeta) bool{}
-	for _, c := range r.Conds {
-		funcs = append(funcs, c.NewMatchFunc(pv))
-	}
-	return func(mm MatchMeta) bool {
-		for _, c := range funcs {
-			if !c(mm) {
-				return false
-			}
-		}
-		return true
-	}
+	return r.Expr.NewMatchFunc(pv)
 }
 
 func (r Rule) NewRuleHandler(pv *FuncProvider, forwards map[string]Forward) RuleHandler {
@@ -231,63 +484,10 @@ func (r Rule) NewRuleHandler(pv *FuncProvider, forwards map[string]Forward) Rule
 	case RuleActionType_Reject:
 		return &RejectRuleHandler{}
 	case RuleActionType_Direct:
-		return &DirectRuleHandler{}
+		return &DirectRuleHandler{pv: pv}
 	case RuleActionType_Forward:
 		return forwards[r.ActionParam]
 	default:
 		return &RejectRuleHandler{}
 	}
 }
-
-type RuleMapper struct {
-	matchs  []func(MatchMeta) bool
-	actions []RuleHandler
-	cache   map[MatchMeta]RuleHandler
-	lock    sync.RWMutex
-}
-
-func NewRuleMapper(
-	rules []string,
-	pv *FuncProvider,
-	forwards map[string]Forward,
-) (*RuleMapper, error) {
-
-	mp := RuleMapper{
-		cache: make(map[MatchMeta]RuleHandler),
-		lock:  sync.RWMutex{},
-	}
-	var rls []Rule
-	for _, rs := range rules {
-		r, err := UnmashalProxyRule(rs)
-		if err != nil {
-			return nil, err
-		}
-		if err = r.Check(forwards); err != nil {
-			return nil, err
-		}
-		rls = append(rls, r)
-	}
-	if len(rls) == 0 {
-		rls = append(rls, Rule{
-			Conds:      []RuleCond{{Cond: RuleCondType_MatchAll}},
-			RuleAction: RuleAction{Action: RuleActionType_Direct},
-		})
-	}
-	for _, r := range rls {
-		mp.matchs = append(mp.matchs, r.NewMatchFunc(pv))
-		mp.actions = append(mp.actions, r.NewRuleHandler(pv, forwards))
-	}
-
-	go func() {
-		tk := time.NewTicker(time.Minute)
-		defer tk.Stop()
-
-		for range tk.C {
-			mp.lock.Lock()
-			mp.cache = make(map[MatchMeta]RuleHandler, len(mp.cache)/2)
-			mp.lock.Unlock()
-		}
-	}()
-
-	return &mp, nil
-}
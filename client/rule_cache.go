@@ -0,0 +1,140 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultRuleCacheSize   = 4096
+	DefaultRuleCacheDNSTTL = time.Minute
+)
+
+type RuleCacheConfig struct {
+	// max cached decisions and resolved hosts, default is DefaultRuleCacheSize,
+	// negative disables the cache
+	Size int
+	// ttl of resolved addresses and decisions depending on them,
+	// default is DefaultRuleCacheDNSTTL
+	DNSTTL time.Duration
+}
+
+type RuleCacheStats struct {
+	Size      int
+	Capacity  int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+type ruleCacheEntry struct {
+	key     MatchMeta
+	handler *ruleStatsHandler
+	// zero if never expired
+	expire time.Time
+}
+
+// ruleCache is a LRU cache of rule decisions
+type ruleCache struct {
+	lock     sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[MatchMeta]*list.Element
+	// increased on purge, decisions made before purge are not put
+	gen uint64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+func newRuleCache(capacity int) *ruleCache {
+	return &ruleCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    map[MatchMeta]*list.Element{},
+	}
+}
+
+func (c *ruleCache) Get(key MatchMeta) (*ruleStatsHandler, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := e.Value.(*ruleCacheEntry)
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	c.hits.Add(1)
+	return entry.handler, true
+}
+
+// Generation returns the current generation, which should be read before
+// making the decision and passed to Put.
+func (c *ruleCache) Generation() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gen
+}
+
+func (c *ruleCache) Put(key MatchMeta, h *ruleStatsHandler, ttl time.Duration, gen uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.capacity <= 0 || gen != c.gen {
+		return
+	}
+	entry := &ruleCacheEntry{key: key, handler: h}
+	if ttl > 0 {
+		entry.expire = time.Now().Add(ttl)
+	}
+	if e, ok := c.items[key]; ok {
+		e.Value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.capacity {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*ruleCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// Purge drops all entries
+func (c *ruleCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ll.Init()
+	c.items = map[MatchMeta]*list.Element{}
+	c.gen++
+}
+
+// Close purges and disables the cache
+func (c *ruleCache) Close() {
+	c.lock.Lock()
+	c.capacity = 0
+	c.lock.Unlock()
+	c.Purge()
+}
+
+func (c *ruleCache) Stats() RuleCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return RuleCacheStats{
+		Size:      c.ll.Len(),
+		Capacity:  c.capacity,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
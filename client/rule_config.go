@@ -0,0 +1,141 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnmashalRuleConfig parses an item of ProxyConfig.Rules, which is either a
+// string rule, see UnmashalProxyRule, or a structured rule:
+//
+//	match:
+//	  host-regexp: '^(www\.)?a{2,3}\.com$'
+//	  dst-port: 443
+//	action: forward
+//	target: tokyo
+//
+// All conditions in match are required, a list of params matches any of them.
+// match can also be an expression string, e.g. 'host-match: a || host-match: b'.
+func UnmashalRuleConfig(v any) (r Rule, err error) {
+	switch v := v.(type) {
+	case string:
+		return UnmashalProxyRule(v)
+	}
+	m, ok := toStringMap(v)
+	if !ok {
+		return r, fmt.Errorf("rule must be a string or a map, got %T", v)
+	}
+	for k := range m {
+		switch strings.ToLower(k) {
+		case "match", "action", "target":
+		default:
+			return r, fmt.Errorf("unknown rule field %q", k)
+		}
+	}
+
+	switch match := lookupKey(m, "match").(type) {
+	case nil:
+		return r, fmt.Errorf("rule match must not empty")
+	case string:
+		r.Expr, err = ParseRuleExpr(match, match, 0)
+		if err != nil {
+			return
+		}
+	default:
+		conds, ok := toStringMap(match)
+		if !ok || len(conds) == 0 {
+			return r, fmt.Errorf("rule match must be a string or a map of conditions")
+		}
+		r.Expr, err = newMatchExpr(conds)
+		if err != nil {
+			return
+		}
+	}
+
+	action, ok := lookupKey(m, "action").(string)
+	if !ok || action == "" {
+		return r, fmt.Errorf("rule action must not empty")
+	}
+	r.Action = RuleActionType(strings.TrimSpace(strings.ToLower(action)))
+	if target := lookupKey(m, "target"); target != nil {
+		r.ActionParam = strings.TrimSpace(fmt.Sprint(target))
+	}
+	return r, nil
+}
+
+// newMatchExpr returns the and expression of conds
+func newMatchExpr(conds map[string]any) (*RuleExpr, error) {
+	// keep the order stable
+	types := make([]string, 0, len(conds))
+	for k := range conds {
+		types = append(types, k)
+	}
+	sort.Strings(types)
+
+	and := &RuleExpr{Op: RuleExprOp_And}
+	for _, t := range types {
+		condType := RuleCondType(strings.TrimSpace(strings.ToLower(t)))
+		var params []any
+		switch p := conds[t].(type) {
+		case []any:
+			params = p
+		case []string:
+			for _, s := range p {
+				params = append(params, s)
+			}
+		default:
+			params = []any{p}
+		}
+		if len(params) == 0 {
+			return nil, fmt.Errorf("rule condition %q params must not empty", condType)
+		}
+		or := &RuleExpr{Op: RuleExprOp_Or}
+		for _, p := range params {
+			if _, ok := toStringMap(p); ok {
+				return nil, fmt.Errorf("rule condition %q params must be a value or a list", condType)
+			}
+			param := ""
+			if p != nil {
+				param = strings.TrimSpace(fmt.Sprint(p))
+			}
+			or.Args = append(or.Args, NewCondExpr(RuleCond{Cond: condType, CondParam: param}))
+		}
+		if len(or.Args) == 1 {
+			and.Args = append(and.Args, or.Args[0])
+		} else {
+			and.Args = append(and.Args, or)
+		}
+	}
+	if len(and.Args) == 1 {
+		return and.Args[0], nil
+	}
+	return and, nil
+}
+
+func toStringMap(v any) (map[string]any, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		return v, true
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = val
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// lookupKey finds key case-insensitively, viper lowercases map keys
+func lookupKey(m map[string]any, key string) any {
+	if v, ok := m[key]; ok {
+		return v
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
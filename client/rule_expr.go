@@ -0,0 +1,292 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+type RuleExprOp string
+
+const (
+	RuleExprOp_Cond RuleExprOp = "cond"
+	RuleExprOp_And  RuleExprOp = "and"
+	RuleExprOp_Or   RuleExprOp = "or"
+	RuleExprOp_Not  RuleExprOp = "not"
+)
+
+// RuleExpr is the condition expression of a rule, e.g.
+//
+//	(host-suffix: google.com || host-suffix: youtube.com) && !dst-port: 80
+//
+// && binds tighter than ||, ! applies to the following condition or group.
+type RuleExpr struct {
+	Op RuleExprOp
+	// Op is cond
+	Cond RuleCond
+	// Op is and, or: two or more, not: one
+	Args []*RuleExpr
+}
+
+func NewCondExpr(c RuleCond) *RuleExpr {
+	return &RuleExpr{Op: RuleExprOp_Cond, Cond: c}
+}
+
+// Conds returns all conditions in the expression
+func (e *RuleExpr) Conds() []RuleCond {
+	if e.Op == RuleExprOp_Cond {
+		return []RuleCond{e.Cond}
+	}
+	var conds []RuleCond
+	for _, a := range e.Args {
+		conds = append(conds, a.Conds()...)
+	}
+	return conds
+}
+
+func (e *RuleExpr) String() string {
+	switch e.Op {
+	case RuleExprOp_Cond:
+		if e.Cond.CondParam == "" {
+			return string(e.Cond.Cond)
+		}
+		return fmt.Sprintf("%s: %s", e.Cond.Cond, e.Cond.CondParam)
+	case RuleExprOp_Not:
+		return "!" + e.Args[0].group()
+	default:
+		sep := " && "
+		if e.Op == RuleExprOp_Or {
+			sep = " || "
+		}
+		args := make([]string, len(e.Args))
+		for i, a := range e.Args {
+			args[i] = a.group()
+		}
+		return strings.Join(args, sep)
+	}
+}
+
+// group returns the string wrapped in parentheses if needed
+func (e *RuleExpr) group() string {
+	if e.Op == RuleExprOp_And || e.Op == RuleExprOp_Or {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func (e *RuleExpr) NewMatchFunc(pv *FuncProvider) func(mm MatchMeta) bool {
+	switch e.Op {
+	case RuleExprOp_Cond:
+		return e.Cond.NewMatchFunc(pv)
+	case RuleExprOp_Not:
+		f := e.Args[0].NewMatchFunc(pv)
+		return func(mm MatchMeta) bool {
+			return !f(mm)
+		}
+	}
+	funcs := make([]func(mm MatchMeta) bool, len(e.Args))
+	for i, a := range e.Args {
+		funcs[i] = a.NewMatchFunc(pv)
+	}
+	if e.Op == RuleExprOp_Or {
+		return func(mm MatchMeta) bool {
+			for _, f := range funcs {
+				if f(mm) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return func(mm MatchMeta) bool {
+		for _, f := range funcs {
+			if !f(mm) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RuleSyntaxError reports where a rule failed to parse
+type RuleSyntaxError struct {
+	Rule string
+	// 1-based position in Rule
+	Column int
+	Msg    string
+}
+
+func (e *RuleSyntaxError) Error() string {
+	return fmt.Sprintf("%v: %s at column %d in rule %q", ErrInvalidSyntax, e.Msg, e.Column, e.Rule)
+}
+
+func (e *RuleSyntaxError) Unwrap() error {
+	return ErrInvalidSyntax
+}
+
+type ruleTokenType int
+
+const (
+	ruleToken_EOF ruleTokenType = iota
+	ruleToken_Cond
+	ruleToken_And
+	ruleToken_Or
+	ruleToken_Not
+	ruleToken_LParen
+	ruleToken_RParen
+)
+
+type ruleToken struct {
+	typ  ruleTokenType
+	text string
+	// 0-based offset in the rule
+	pos int
+}
+
+// tokenizeRuleExpr splits s into tokens, offset is the position of s in
+// the whole rule. A condition extends to the next && or ||, or to a ) which
+// is not balanced in its params, so regexps like (a|b) can be used.
+func tokenizeRuleExpr(s string, offset int) []ruleToken {
+	var tokens []ruleToken
+	i := 0
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t':
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, ruleToken{ruleToken_And, "&&", offset + i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, ruleToken{ruleToken_Or, "||", offset + i})
+			i += 2
+		case s[i] == '!':
+			tokens = append(tokens, ruleToken{ruleToken_Not, "!", offset + i})
+			i++
+		case s[i] == '(':
+			tokens = append(tokens, ruleToken{ruleToken_LParen, "(", offset + i})
+			i++
+		case s[i] == ')':
+			tokens = append(tokens, ruleToken{ruleToken_RParen, ")", offset + i})
+			i++
+		default:
+			start, depth := i, 0
+		cond:
+			for ; i < len(s); i++ {
+				switch {
+				case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"):
+					break cond
+				case s[i] == '(':
+					depth++
+				case s[i] == ')':
+					if depth == 0 {
+						break cond
+					}
+					depth--
+				}
+			}
+			tokens = append(tokens, ruleToken{ruleToken_Cond, strings.TrimRight(s[start:i], " \t"), offset + start})
+		}
+	}
+	return append(tokens, ruleToken{ruleToken_EOF, "", offset + len(s)})
+}
+
+type ruleParser struct {
+	raw    string
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.tokens[p.pos]
+	if t.typ != ruleToken_EOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) errorf(t ruleToken, format string, args ...any) error {
+	return &RuleSyntaxError{Rule: p.raw, Column: t.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// or := and ('||' and)*
+func (p *ruleParser) parseOr() (*RuleExpr, error) {
+	return p.parseBinary(RuleExprOp_Or, ruleToken_Or, p.parseAnd)
+}
+
+// and := unary ('&&' unary)*
+func (p *ruleParser) parseAnd() (*RuleExpr, error) {
+	return p.parseBinary(RuleExprOp_And, ruleToken_And, p.parseUnary)
+}
+
+func (p *ruleParser) parseBinary(op RuleExprOp, tt ruleTokenType, operand func() (*RuleExpr, error)) (*RuleExpr, error) {
+	e, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	args := []*RuleExpr{e}
+	for p.peek().typ == tt {
+		p.next()
+		e, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return &RuleExpr{Op: op, Args: args}, nil
+}
+
+// unary := '!' unary | '(' or ')' | cond
+func (p *ruleParser) parseUnary() (*RuleExpr, error) {
+	t := p.next()
+	switch t.typ {
+	case ruleToken_Not:
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &RuleExpr{Op: RuleExprOp_Not, Args: []*RuleExpr{e}}, nil
+	case ruleToken_LParen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.typ != ruleToken_RParen {
+			return nil, p.errorf(t, "unclosed (")
+		}
+		return e, nil
+	case ruleToken_Cond:
+		condStr := strings.SplitN(t.text, ":", 2)
+		cond := RuleCond{Cond: RuleCondType(strings.TrimSpace(strings.ToLower(condStr[0])))}
+		if cond.Cond == "" {
+			return nil, p.errorf(t, "missing condition type")
+		}
+		if len(condStr) > 1 {
+			cond.CondParam = strings.TrimSpace(condStr[1])
+		}
+		return NewCondExpr(cond), nil
+	case ruleToken_EOF:
+		return nil, p.errorf(t, "expect condition")
+	default:
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+}
+
+// ParseRuleExpr parses the condition expression s, which starts at offset
+// of the rule raw, positions of errors are reported in raw.
+func ParseRuleExpr(raw, s string, offset int) (*RuleExpr, error) {
+	p := &ruleParser{raw: raw, tokens: tokenizeRuleExpr(s, offset)}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != ruleToken_EOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return e, nil
+}
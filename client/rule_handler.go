@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
@@ -25,11 +26,19 @@ func (h *RejectRuleHandler) Conn(conn net.Conn, remote *transform.Meta) {
 	conn.Close()
 }
 
-type DirectRuleHandler struct{}
+// DirectRuleHandler connects to the remote directly, reusing the addresses
+// resolved while matching rules.
+type DirectRuleHandler struct {
+	pv *FuncProvider
+}
 
 func (h *DirectRuleHandler) HTTPRequest(w http.ResponseWriter, r *http.Request) {
 	logger.With("url", r.URL).Info("direct request")
-	resp, err := http.DefaultClient.Do(r)
+	client := http.DefaultClient
+	if h.pv != nil {
+		client = h.pv.direct
+	}
+	resp, err := client.Do(r)
 	if err != nil {
 		logger.With("url", r.URL.String()).Errorf("http call err: %v", err)
 		ResponseError(w, err)
@@ -41,7 +50,9 @@ func (h *DirectRuleHandler) HTTPRequest(w http.ResponseWriter, r *http.Request)
 
 func (h *DirectRuleHandler) Conn(conn net.Conn, remote *transform.Meta) {
 	defer conn.Close()
-	remoteConn, err := net.Dial(remote.Net, remote.Addr)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDirectDialTimeout)
+	remoteConn, err := h.pv.DialContext(ctx, remote.Net, remote.Addr)
+	cancel()
 	if err != nil {
 		return
 	}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ruleTable is the compiled rules, it is replaced as a whole on reload
+type ruleTable struct {
+	rules   []Rule
+	matchs  []func(MatchMeta) bool
+	actions []RuleHandler
+	// actions wrapped with counters
+	handlers []*ruleStatsHandler
+	// used when no rule matched
+	fallback *ruleStatsHandler
+	// compiled from matchs of rules not resolving the host, see compileRules
+	steps []func(MatchMeta) int
+	// indexes of rules resolving the host, checked after steps
+	deferred []int
+	// rule sets used by rules, whether they had CIDR entries when compiled
+	ruleSets map[string]bool
+	// condition types used by rules
+	conds map[RuleCondType]bool
+}
+
+func newRuleTable(rules []any, pv *FuncProvider, forwards map[string]Forward) (*ruleTable, error) {
+	t := &ruleTable{conds: map[RuleCondType]bool{}}
+	for i, rs := range rules {
+		r, err := UnmashalRuleConfig(rs)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if err = r.Check(pv, forwards); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		t.rules = append(t.rules, r)
+	}
+	if len(t.rules) == 0 {
+		t.rules = append(t.rules, Rule{
+			Expr:       NewCondExpr(RuleCond{Cond: RuleCondType_MatchAll}),
+			RuleAction: RuleAction{Action: RuleActionType_Direct},
+		})
+	}
+	for i, r := range t.rules {
+		t.matchs = append(t.matchs, r.NewMatchFunc(pv))
+		t.actions = append(t.actions, r.NewRuleHandler(pv, forwards))
+		t.handlers = append(t.handlers, newRuleStatsHandler(i+1, r.String(), t.actions[i]))
+		for _, c := range r.Conds() {
+			t.conds[c.Cond] = true
+		}
+	}
+	t.fallback = newRuleStatsHandler(0, "no rule matched, direct", &DirectRuleHandler{pv: pv})
+	t.compile(pv)
+	// the used geosite categories are compiled
+	pv.releaseGeoSite()
+	return t, nil
+}
+
+// compile splits rules into steps and deferred ones by whether they
+// resolve the host
+func (t *ruleTable) compile(pv *FuncProvider) {
+	var direct []int
+	t.deferred = nil
+	t.ruleSets = map[string]bool{}
+	for i, r := range t.rules {
+		resolve := false
+		for _, c := range r.Conds() {
+			need := c.NeedResolve(pv)
+			if c.Cond == RuleCondType_RuleSet {
+				t.ruleSets[c.CondParam] = need
+			}
+			resolve = resolve || need
+		}
+		if resolve {
+			t.deferred = append(t.deferred, i)
+		} else {
+			direct = append(direct, i)
+		}
+	}
+	// domain rules separated by ip rules are merged as well
+	t.steps = compileRules(pv, t.rules, t.matchs, direct)
+}
+
+// stale reports whether a rule set gained or lost CIDR entries since the
+// table was compiled
+func (t *ruleTable) stale(pv *FuncProvider) bool {
+	for name, hasCIDR := range t.ruleSets {
+		if p := pv.RuleProvider(name); p != nil && p.RuleSet().HasCIDR() != hasCIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the handler of the first matched rule, and whether the
+// decision depends on DNS resolution.
+//
+// Rules not resolving the host are checked first, the host is resolved
+// only if a rule resolving it is before the first matched one.
+func (t *ruleTable) match(mm MatchMeta) (*ruleStatsHandler, bool) {
+	matched := -1
+	for _, step := range t.steps {
+		if i := step(mm); i >= 0 {
+			matched = i
+			break
+		}
+	}
+	resolve := false
+	for _, i := range t.deferred {
+		if matched >= 0 && i > matched {
+			break
+		}
+		resolve = true
+		if t.matchs[i](mm) {
+			return t.handlers[i], true
+		}
+	}
+	if matched < 0 {
+		return t.fallback, resolve
+	}
+	return t.handlers[matched], resolve
+}
+
+// cacheKey drops the fields of mm not used by any rule, so the cache is not
+// fragmented by ports or clients.
+func (t *ruleTable) cacheKey(mm MatchMeta) MatchMeta {
+	key := MatchMeta{Host: mm.Host}
+	if t.conds[RuleCondType_DstPort] {
+		key.Port = mm.Port
+	}
+	if t.conds[RuleCondType_SrcIPCIDR] {
+		key.SrcIP = mm.SrcIP
+	}
+	if t.conds[RuleCondType_Inbound] {
+		key.Inbound = mm.Inbound
+	}
+	if t.conds[RuleCondType_Network] {
+		key.Network = mm.Network
+	}
+	if t.conds[RuleCondType_ProcessName] || t.conds[RuleCondType_ProcessPath] {
+		key.ProcessPath = mm.ProcessPath
+	}
+	return key
+}
+
+type RuleMapper struct {
+	pv       *FuncProvider
+	forwards map[string]Forward
+	config   RuleCacheConfig
+
+	table atomic.Pointer[ruleTable]
+	cache *ruleCache
+}
+
+func NewRuleMapper(
+	rules []any,
+	cacheConfig RuleCacheConfig,
+	pv *FuncProvider,
+	forwards map[string]Forward,
+) (*RuleMapper, error) {
+	if cacheConfig.Size == 0 {
+		cacheConfig.Size = DefaultRuleCacheSize
+	}
+	if cacheConfig.DNSTTL <= 0 {
+		cacheConfig.DNSTTL = DefaultRuleCacheDNSTTL
+	}
+	t, err := newRuleTable(rules, pv, forwards)
+	if err != nil {
+		return nil, err
+	}
+	mp := &RuleMapper{
+		pv:       pv,
+		forwards: forwards,
+		config:   cacheConfig,
+		cache:    newRuleCache(cacheConfig.Size),
+	}
+	mp.table.Store(t)
+	if pv != nil {
+		for _, p := range pv.ruleSets {
+			p.OnReload(mp.onRuleSetReload)
+		}
+		// so are decisions of geoip and ip-asn rules
+		pv.OnGeoIPReload(mp.ClearCache)
+	}
+	return mp, nil
+}
+
+func (rm *RuleMapper) Match(meta MatchMeta) RuleHandler {
+	// read the generation first, decisions of a replaced table are not cached
+	gen := rm.cache.Generation()
+	t := rm.table.Load()
+	key := t.cacheKey(meta)
+	h, ok := rm.cache.Get(key)
+	if !ok {
+		var resolve bool
+		h, resolve = t.match(meta)
+		var ttl time.Duration
+		if resolve {
+			ttl = rm.config.DNSTTL
+		}
+		rm.cache.Put(key, h, ttl, gen)
+	}
+	h.stats.matches.Add(1)
+	return h
+}
+
+// Reload replaces the rules, the old rules are kept if the new ones are invalid
+func (rm *RuleMapper) Reload(rules []any) error {
+	t, err := newRuleTable(rules, rm.pv, rm.forwards)
+	if err != nil {
+		return err
+	}
+	rm.table.Store(t)
+	rm.cache.Purge()
+	logger.Infof("rules reloaded, %d rules", len(t.rules))
+	return nil
+}
+
+// NeedProcess reports whether MatchMeta.ProcessPath should be filled,
+// finding process is expensive and only done if rules need it.
+func (rm *RuleMapper) NeedProcess() bool {
+	t := rm.table.Load()
+	return t.conds[RuleCondType_ProcessName] || t.conds[RuleCondType_ProcessPath]
+}
+
+// onRuleSetReload recompiles the rules if a set gained or lost CIDR
+// entries, cached decisions may be changed by the new set as well
+func (rm *RuleMapper) onRuleSetReload() {
+	if t := rm.table.Load(); t.stale(rm.pv) {
+		// matchs and handlers are shared, so are the counters
+		nt := *t
+		nt.compile(rm.pv)
+		rm.table.CompareAndSwap(t, &nt)
+	}
+	rm.ClearCache()
+}
+
+// ClearCache drops all cached decisions
+func (rm *RuleMapper) ClearCache() {
+	rm.cache.Purge()
+}
+
+// Stats returns the counters of rules, counters are reset on reload
+func (rm *RuleMapper) Stats() []RuleStats {
+	t := rm.table.Load()
+	stats := make([]RuleStats, 0, len(t.handlers)+1)
+	for _, h := range t.handlers {
+		stats = append(stats, h.Stats())
+	}
+	return append(stats, t.fallback.Stats())
+}
+
+func (rm *RuleMapper) CacheStats() RuleCacheStats {
+	return rm.cache.Stats()
+}
+
+// Close drops the cache, Match still works without caching
+func (rm *RuleMapper) Close() error {
+	rm.cache.Close()
+	return nil
+}
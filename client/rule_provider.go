@@ -0,0 +1,287 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type RuleProviderFormat string
+
+const (
+	// one domain per line
+	RuleProviderFormat_Domain RuleProviderFormat = "domain"
+	// one CIDR or IP per line
+	RuleProviderFormat_CIDR RuleProviderFormat = "cidr"
+	// domains and CIDRs in the payload list
+	RuleProviderFormat_YAML RuleProviderFormat = "yaml"
+)
+
+const (
+	DefaultRuleProviderInterval = 10 * time.Second
+)
+
+type RuleProviderConfig struct {
+	Name   string
+	Path   string
+	Format RuleProviderFormat
+
+	// interval of checking file changes, default is DefaultRuleProviderInterval
+	Interval time.Duration
+}
+
+// RuleSet is the compiled content of a rule provider file
+//
+// Domain entries:
+//
+//	example.com        example.com and its subdomains
+//	+.example.com      same as above
+//	.example.com       same as above
+//	full:example.com   only example.com
+type RuleSet struct {
+	full   map[string]bool
+	suffix map[string]bool
+	cidrs  []*net.IPNet
+}
+
+func newRuleSet() *RuleSet {
+	return &RuleSet{
+		full:   map[string]bool{},
+		suffix: map[string]bool{},
+	}
+}
+
+func (s *RuleSet) addDomain(entry string) {
+	entry = strings.ToLower(entry)
+	if d, ok := strings.CutPrefix(entry, "full:"); ok {
+		s.full[d] = true
+		return
+	}
+	entry = strings.TrimPrefix(entry, "+")
+	entry = strings.TrimPrefix(entry, ".")
+	s.suffix[entry] = true
+}
+
+func (s *RuleSet) addCIDR(entry string) error {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		s.cidrs = append(s.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+	s.cidrs = append(s.cidrs, ipnet)
+	return nil
+}
+
+// MatchDomain reports whether host matches a domain entry
+func (s *RuleSet) MatchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if s.full[host] {
+		return true
+	}
+	for {
+		if s.suffix[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// HasCIDR reports whether the set has CIDR entries, matching them
+// requires resolving the host.
+func (s *RuleSet) HasCIDR() bool {
+	return len(s.cidrs) > 0
+}
+
+func (s *RuleSet) MatchIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, c := range s.cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RuleSet) Len() int {
+	return len(s.full) + len(s.suffix) + len(s.cidrs)
+}
+
+func ParseRuleSet(raw []byte, format RuleProviderFormat) (*RuleSet, error) {
+	s := newRuleSet()
+	switch format {
+	case RuleProviderFormat_Domain, RuleProviderFormat_CIDR:
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if format == RuleProviderFormat_Domain {
+				s.addDomain(line)
+			} else if err := s.addCIDR(line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case RuleProviderFormat_YAML:
+		var doc struct {
+			Payload []string `yaml:"payload"`
+		}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		for _, entry := range doc.Payload {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if s.addCIDR(entry) != nil {
+				s.addDomain(entry)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupport rule provider format %q", format)
+	}
+	return s, nil
+}
+
+// RuleProvider loads a rule set from file, and reloads it when the file
+// is changed. The compiled set is swapped atomically.
+type RuleProvider struct {
+	Config RuleProviderConfig
+
+	set     atomic.Pointer[RuleSet]
+	modTime time.Time
+	size    int64
+
+	lock     sync.Mutex
+	onReload []func()
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRuleProvider(cfg RuleProviderConfig) (*RuleProvider, error) {
+	if cfg.Name == "" || cfg.Path == "" {
+		return nil, fmt.Errorf("rule provider name and path must not empty")
+	}
+	if cfg.Format == "" {
+		cfg.Format = RuleProviderFormat_Domain
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRuleProviderInterval
+	}
+	p := &RuleProvider{
+		Config: cfg,
+		done:   make(chan struct{}),
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *RuleProvider) load() error {
+	fi, err := os.Stat(p.Config.Path)
+	if err != nil {
+		return fmt.Errorf("rule provider %s: %v", p.Config.Name, err)
+	}
+	raw, err := os.ReadFile(p.Config.Path)
+	if err != nil {
+		return fmt.Errorf("rule provider %s: %v", p.Config.Name, err)
+	}
+	set, err := ParseRuleSet(raw, p.Config.Format)
+	if err != nil {
+		return fmt.Errorf("rule provider %s parse %s err: %v", p.Config.Name, p.Config.Path, err)
+	}
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+	p.set.Store(set)
+	logger.Infof("rule provider %s loaded %d entries from %s", p.Config.Name, set.Len(), p.Config.Path)
+	return nil
+}
+
+// Start watches the file and reloads it when changed
+func (p *RuleProvider) Start() {
+	go func() {
+		tk := time.NewTicker(p.Config.Interval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				p.reloadIfChanged()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *RuleProvider) reloadIfChanged() {
+	fi, err := os.Stat(p.Config.Path)
+	if err != nil {
+		logger.Warnf("rule provider %s stat err: %v", p.Config.Name, err)
+		return
+	}
+	if fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return
+	}
+	if err := p.load(); err != nil {
+		// keep the old set, and don't retry until the file is changed again
+		p.modTime, p.size = fi.ModTime(), fi.Size()
+		logger.Errorf("reload %v", err)
+		return
+	}
+	p.lock.Lock()
+	fns := p.onReload
+	p.lock.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// OnReload registers fn called after the set is reloaded
+func (p *RuleProvider) OnReload(fn func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.onReload = append(p.onReload, fn)
+}
+
+func (p *RuleProvider) RuleSet() *RuleSet {
+	return p.set.Load()
+}
+
+func (p *RuleProvider) Close() error {
+	p.stopOnce.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	set, err := ParseRuleSet([]byte(`
+payload:
+  - '+.google.com'
+  - 'full:example.com'
+  - '10.0.0.0/8'
+  - '1.1.1.1'
+`), RuleProviderFormat_YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"google.com":      true,
+		"www.google.com":  true,
+		"notgoogle.com":   false,
+		"example.com":     true,
+		"www.example.com": false,
+		"example.com.cn":  false,
+		"www.GOOGLE.com.": true,
+	} {
+		if got := set.MatchDomain(host); got != want {
+			t.Errorf("MatchDomain(%q) = %v, want %v", host, got, want)
+		}
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3": true,
+		"1.1.1.1":  true,
+		"1.1.1.2":  false,
+	} {
+		if got := set.MatchIP(net.ParseIP(ip)); got != want {
+			t.Errorf("MatchIP(%q) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if _, err := ParseRuleSet([]byte("10.0.0.0/8\nexample.com\n"), RuleProviderFormat_CIDR); err == nil {
+		t.Error("expect error of invalid cidr list")
+	}
+}
+
+func TestRuleProviderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte("# comment\nexample.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewRuleProvider(RuleProviderConfig{Name: "test", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	reloaded := false
+	p.OnReload(func() { reloaded = true })
+
+	if err := os.WriteFile(path, []byte("example.org\nexample.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.reloadIfChanged()
+	if !reloaded {
+		t.Fatal("expect reload callback")
+	}
+	if p.RuleSet().MatchDomain("example.com") || !p.RuleSet().MatchDomain("a.example.net") {
+		t.Error("rule set is not swapped")
+	}
+
+	// keep the old set if the new file is invalid
+	p.Config.Format = RuleProviderFormat_CIDR
+	os.WriteFile(path, []byte("not a cidr\n"), 0644)
+	p.reloadIfChanged()
+	if !p.RuleSet().MatchDomain("example.org") {
+		t.Error("old rule set should be kept")
+	}
+	fi, _ := os.Stat(path)
+	if !p.modTime.Equal(fi.ModTime()) || p.size != fi.Size() {
+		t.Error("failed file should not be reloaded again")
+	}
+}
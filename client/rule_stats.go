@@ -0,0 +1,113 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+// RuleStats is the traffic handled by a rule since the rules are loaded
+type RuleStats struct {
+	// 1-based index in rules, 0 is the fallback when no rule matched
+	Index       int
+	Rule        string
+	Matches     int64
+	ActiveConns int64
+	// bytes from client to remote
+	BytesUp int64
+	// bytes from remote to client
+	BytesDown int64
+}
+
+type ruleCounters struct {
+	matches   atomic.Int64
+	active    atomic.Int64
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+}
+
+// ruleStatsHandler counts connections and bytes of handler
+type ruleStatsHandler struct {
+	index   int
+	rule    string
+	handler RuleHandler
+	stats   ruleCounters
+}
+
+func newRuleStatsHandler(index int, rule string, h RuleHandler) *ruleStatsHandler {
+	return &ruleStatsHandler{index: index, rule: rule, handler: h}
+}
+
+func (h *ruleStatsHandler) HTTPRequest(w http.ResponseWriter, r *http.Request) {
+	h.stats.active.Add(1)
+	defer h.stats.active.Add(-1)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countReadCloser{ReadCloser: r.Body, n: &h.stats.bytesUp}
+	}
+	h.handler.HTTPRequest(&countResponseWriter{ResponseWriter: w, n: &h.stats.bytesDown}, r)
+}
+
+func (h *ruleStatsHandler) Conn(conn net.Conn, remote *transform.Meta) {
+	h.stats.active.Add(1)
+	defer h.stats.active.Add(-1)
+	h.handler.Conn(&countConn{Conn: conn, up: &h.stats.bytesUp, down: &h.stats.bytesDown}, remote)
+}
+
+func (h *ruleStatsHandler) Stats() RuleStats {
+	return RuleStats{
+		Index:       h.index,
+		Rule:        h.rule,
+		Matches:     h.stats.matches.Load(),
+		ActiveConns: h.stats.active.Load(),
+		BytesUp:     h.stats.bytesUp.Load(),
+		BytesDown:   h.stats.bytesDown.Load(),
+	}
+}
+
+// countConn counts bytes of the client connection
+type countConn struct {
+	net.Conn
+	up   *atomic.Int64
+	down *atomic.Int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.up.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.down.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) CloseWrite() error {
+	return transform.CloseWrite(c.Conn)
+}
+
+type countReadCloser struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+type countResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,433 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mengseeker/nlink/core/geoip"
+	"github.com/mengseeker/nlink/core/geoip/geoiptest"
+	"github.com/mengseeker/nlink/core/socks"
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+func TestUnmashalProxyRule(t *testing.T) {
+	cases := []struct {
+		raw  string
+		expr string
+	}{
+		{"match-all, direct", "match-all"},
+		{"host-suffix: a.com && dst-port: 443, forward: tokyo", "host-suffix: a.com && dst-port: 443"},
+		{"host-suffix: a.com || host-suffix: b.com && !dst-port: 80, reject", "host-suffix: a.com || (host-suffix: b.com && !dst-port: 80)"},
+		{"!(host-match: cdn || inbound: socks5) && network: tcp, direct", "!(host-match: cdn || inbound: socks5) && network: tcp"},
+		{"host-regexp: ^(a|b)\\.com$ && !!match-all, direct", "host-regexp: ^(a|b)\\.com$ && !!match-all"},
+		{"(host-regexp: x{1,3}), direct", "host-regexp: x{1,3}"},
+	}
+	for _, c := range cases {
+		r, err := UnmashalProxyRule(c.raw)
+		if err != nil {
+			t.Errorf("parse %q err: %v", c.raw, err)
+			continue
+		}
+		if got := r.Expr.String(); got != c.expr {
+			t.Errorf("parse %q got %q, want %q", c.raw, got, c.expr)
+		}
+	}
+
+	errCases := []struct {
+		raw    string
+		column int
+	}{
+		{"match-all", 10},
+		{"match-all,", 11},
+		{"(host-match: a || host-match: b, direct", 1},
+		{"host-match: a && , direct", 18},
+		{"host-match: a ) , direct", 15},
+		{"host-match: a || || host-match: b, direct", 18},
+		{": a, direct", 1},
+	}
+	for _, c := range errCases {
+		_, err := UnmashalProxyRule(c.raw)
+		var se *RuleSyntaxError
+		if !errors.As(err, &se) || !errors.Is(err, ErrInvalidSyntax) {
+			t.Errorf("parse %q expect syntax error, got %v", c.raw, err)
+			continue
+		}
+		if se.Column != c.column {
+			t.Errorf("parse %q error column %d, want %d: %v", c.raw, se.Column, c.column, err)
+		}
+	}
+}
+
+func TestRuleExprMatch(t *testing.T) {
+	r, err := UnmashalProxyRule("(host-suffix: a.com || host-suffix: b.com) && !dst-port: 80, direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := r.NewMatchFunc(nil)
+	for mm, want := range map[MatchMeta]bool{
+		{Host: "x.a.com", Port: "443"}: true,
+		{Host: "b.com", Port: "443"}:   true,
+		{Host: "b.com", Port: "80"}:    false,
+		{Host: "c.com", Port: "443"}:   false,
+	} {
+		if got := match(mm); got != want {
+			t.Errorf("match %+v got %v, want %v", mm, got, want)
+		}
+	}
+}
+
+func TestConnCondMatch(t *testing.T) {
+	cases := []struct {
+		cond string
+		mm   MatchMeta
+		want bool
+	}{
+		{"dst-port: 443", MatchMeta{Port: "443"}, true},
+		{"dst-port: 443", MatchMeta{Port: "80"}, false},
+		{"dst-port: 443", MatchMeta{}, false},
+		{"dst-port: 8000-9000", MatchMeta{Port: "8000"}, true},
+		{"dst-port: 8000-9000", MatchMeta{Port: "9000"}, true},
+		{"dst-port: 8000-9000", MatchMeta{Port: "9001"}, false},
+		{"src-ip-cidr: 192.168.1.0/24", MatchMeta{SrcIP: "192.168.1.100"}, true},
+		{"src-ip-cidr: 192.168.1.0/24", MatchMeta{SrcIP: "192.168.2.1"}, false},
+		{"src-ip-cidr: 192.168.1.0/24", MatchMeta{}, false},
+		{"src-ip-cidr: fd00::/8", MatchMeta{SrcIP: "fd00::1"}, true},
+		{"inbound: socks5", MatchMeta{Inbound: socks.SOCKS5}, true},
+		{"inbound: SOCKS5", MatchMeta{Inbound: socks.SOCKS4}, false},
+		{"inbound: https-connect", MatchMeta{Inbound: socks.HTTPCONNECT}, true},
+		{"inbound: http", MatchMeta{Inbound: socks.HTTPCONNECT}, false},
+		{"network: tcp", MatchMeta{Network: socks.TCP}, true},
+		{"network: tcp", MatchMeta{Network: socks.UDP}, false},
+		{"network: UDP", MatchMeta{Network: socks.UDP}, true},
+		{"network: udp", MatchMeta{Network: socks.TCP}, false},
+	}
+	for _, c := range cases {
+		r, err := UnmashalProxyRule(c.cond + ", direct")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Check(nil, nil); err != nil {
+			t.Fatalf("%s: %v", c.cond, err)
+		}
+		if got := r.NewMatchFunc(nil)(c.mm); got != c.want {
+			t.Errorf("%s match %+v got %v, want %v", c.cond, c.mm, got, c.want)
+		}
+	}
+
+	for _, cond := range []string{"dst-port: 9000-8000", "dst-port: 70000", "dst-port: x", "inbound: tun", "network: quic"} {
+		r, _ := UnmashalProxyRule(cond + ", direct")
+		if err := r.Check(nil, nil); err == nil {
+			t.Errorf("%s: expect check error", cond)
+		}
+	}
+}
+
+func TestIPMatchMode(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("1.1.1.1")}
+	if !matchIPs(ips, false, ipnet.Contains) {
+		t.Error("any should match")
+	}
+	if matchIPs(ips, true, ipnet.Contains) {
+		t.Error("all should not match")
+	}
+	if matchIPs(nil, true, ipnet.Contains) {
+		t.Error("all of no address should not match")
+	}
+
+	r, err := UnmashalProxyRule("ip-cidr: 10.0.0.0/8@all, direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(&FuncProvider{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	match := r.NewMatchFunc(&FuncProvider{})
+	if !match(MatchMeta{Host: "10.1.2.3"}) || match(MatchMeta{Host: "::1"}) {
+		t.Error("ip-cidr on ip literal mismatched")
+	}
+
+	r, _ = UnmashalProxyRule("ip-cidr: 10.0.0.0/8@some, direct")
+	if err := r.Check(&FuncProvider{}, nil); err == nil {
+		t.Error("expect invalid match mode error")
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	for host, want := range map[string][2]string{
+		"example.com":      {"example.com", ""},
+		"example.com:443":  {"example.com", "443"},
+		"1.2.3.4:80":       {"1.2.3.4", "80"},
+		"[2001:db8::1]:80": {"2001:db8::1", "80"},
+		"[2001:db8::1]":    {"2001:db8::1", ""},
+		"2001:db8::1":      {"2001:db8::1", ""},
+	} {
+		domain, port := ParseHost(host)
+		if domain != want[0] || port != want[1] {
+			t.Errorf("ParseHost(%q) got %q %q, want %q %q", host, domain, port, want[0], want[1])
+		}
+	}
+}
+
+func TestUnmashalRuleConfig(t *testing.T) {
+	r, err := UnmashalRuleConfig(map[string]any{
+		"match": map[string]any{
+			"host-regexp": `^a{2,3}\.com$`,
+			"dst-port":    443,
+			"inbound":     []any{"http", "socks5"},
+		},
+		"action": "forward",
+		"target": "tokyo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `dst-port: 443 && host-regexp: ^a{2,3}\.com$ && (inbound: http || inbound: socks5)`
+	if got := r.Expr.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.Action != RuleActionType_Forward || r.ActionParam != "tokyo" {
+		t.Errorf("got action %+v", r.RuleAction)
+	}
+
+	r, err = UnmashalRuleConfig(map[string]any{"match": "host-match: a || host-match: b", "action": "direct"})
+	if err != nil || r.Expr.Op != RuleExprOp_Or {
+		t.Errorf("parse expression match got %v, err: %v", r.Expr, err)
+	}
+
+	for _, v := range []any{
+		1,
+		map[string]any{"action": "direct"},
+		map[string]any{"match": map[string]any{"match-all": nil}},
+		map[string]any{"match": map[string]any{"match-all": nil}, "action": "direct", "typo": 1},
+	} {
+		if _, err := UnmashalRuleConfig(v); err == nil {
+			t.Errorf("expect error of %v", v)
+		}
+	}
+}
+
+func TestRuleCache(t *testing.T) {
+	c := newRuleCache(2)
+	direct, reject := newRuleStatsHandler(1, "", &DirectRuleHandler{}), newRuleStatsHandler(2, "", &RejectRuleHandler{})
+	a, b, d := MatchMeta{Host: "a"}, MatchMeta{Host: "b"}, MatchMeta{Host: "d"}
+
+	gen := c.Generation()
+	c.Put(a, direct, 0, gen)
+	c.Put(b, reject, time.Nanosecond, gen)
+	c.Get(a)
+	c.Put(d, direct, 0, gen)
+	if _, ok := c.Get(b); ok {
+		t.Error("least recently used entry should be evicted")
+	}
+	if h, ok := c.Get(a); !ok || h != direct {
+		t.Error("expect cached entry")
+	}
+
+	c.Put(b, reject, time.Nanosecond, gen)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Get(b); ok {
+		t.Error("entry should be expired")
+	}
+
+	c.Purge()
+	c.Put(a, direct, 0, gen)
+	if _, ok := c.Get(a); ok {
+		t.Error("decision of old generation should not be cached")
+	}
+	if s := c.Stats(); s.Hits != 2 || s.Evictions != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestRuleMapperCacheKey(t *testing.T) {
+	mp, err := NewRuleMapper([]any{"host-suffix: a.com && dst-port: 443, reject"}, RuleCacheConfig{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	if HandlerName(mp.Match(MatchMeta{Host: "a.com", Port: "443", SrcIP: "10.0.0.1"})) != "reject" {
+		t.Error("expect reject")
+	}
+	if HandlerName(mp.Match(MatchMeta{Host: "a.com", Port: "80", SrcIP: "10.0.0.2"})) != "direct" {
+		t.Error("expect direct")
+	}
+	if s := mp.CacheStats(); s.Size != 2 {
+		t.Errorf("expect 2 entries, got %+v", s)
+	}
+	if err := mp.Reload([]any{"match-all, reject"}); err != nil {
+		t.Fatal(err)
+	}
+	if HandlerName(mp.Match(MatchMeta{Host: "a.com", Port: "80"})) != "reject" {
+		t.Error("expect reject after reload")
+	}
+}
+
+type echoRuleHandler struct{}
+
+func (h *echoRuleHandler) HTTPRequest(w http.ResponseWriter, r *http.Request) {}
+
+func (h *echoRuleHandler) Conn(conn net.Conn, remote *transform.Meta) {
+	defer conn.Close()
+	buf := make([]byte, 16)
+	n, _ := conn.Read(buf)
+	conn.Write(buf[:n])
+	conn.Write(buf[:n])
+}
+
+func TestRuleTableDeferResolve(t *testing.T) {
+	pv := &FuncProvider{dns: newDNSCache(0, 0)}
+	tb, err := newRuleTable([]any{
+		"host-suffix: a.com, reject",
+		"ip-cidr: 10.0.0.0/8, reject",
+		"host-suffix: b.com, reject",
+		"host-suffix: c.com, direct",
+	}, pv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := 0
+	pv.setTracer(func(l LookupTrace) { resolved++ })
+	for host, want := range map[string]int{
+		"x.a.com":  1,
+		"b.com":    3,
+		"d.com":    0,
+		"10.1.1.1": 2,
+	} {
+		h, _ := tb.match(MatchMeta{Host: host})
+		if h.index != want {
+			t.Errorf("host %s matched rule %d, want %d", host, h.index, want)
+		}
+	}
+	// x.a.com matched before the ip rule, 10.1.1.1 is not resolved
+	if resolved != 2 {
+		t.Errorf("expect 2 lookups, got %d", resolved)
+	}
+}
+
+func TestRuleStatsHandler(t *testing.T) {
+	h := newRuleStatsHandler(1, "match-all, direct", &echoRuleHandler{})
+	local, remote := net.Pipe()
+	go func() {
+		local.Write([]byte("hello"))
+		io.Copy(io.Discard, local)
+	}()
+	h.Conn(remote, &transform.Meta{})
+	s := h.Stats()
+	if s.BytesUp != 5 || s.BytesDown != 10 || s.ActiveConns != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestParseASN(t *testing.T) {
+	for s, want := range map[string]uint{
+		"13335":   13335,
+		"AS13335": 13335,
+		"as13335": 13335,
+		"0":       0,
+		"AS":      0,
+		"ASx":     0,
+		"-1":      0,
+	} {
+		got, err := parseASN(s)
+		if got != want || (err == nil) != (want != 0) {
+			t.Errorf("parseASN(%q) = %d, %v", s, got, err)
+		}
+	}
+}
+
+func writeTestASN(t *testing.T, path string, asn uint32) {
+	err := geoiptest.Write(path, "GeoLite2-ASN", map[string]any{
+		"1.1.1.0/24": map[string]any{"autonomous_system_number": asn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuleMapperASN(t *testing.T) {
+	dir := t.TempDir()
+	countryPath, asnPath := filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	if err := geoiptest.Write(countryPath, "GeoLite2-Country", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeTestASN(t, asnPath, 13335)
+	pv := &FuncProvider{
+		dns:         newDNSCache(0, 0),
+		geoipConfig: geoip.Config{Country: countryPath, ASN: asnPath, Interval: 10 * time.Millisecond},
+	}
+	defer pv.Close()
+	mp, err := NewRuleMapper([]any{"ip-asn: AS13335, reject"}, RuleCacheConfig{}, pv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	if HandlerName(mp.Match(MatchMeta{Host: "1.1.1.1"})) != "reject" {
+		t.Error("expect reject")
+	}
+	if HandlerName(mp.Match(MatchMeta{Host: "8.8.8.8"})) != "direct" {
+		t.Error("expect direct")
+	}
+
+	// the cached decision is dropped after the database is reloaded
+	writeTestASN(t, asnPath, 15169)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(asnPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return HandlerName(mp.Match(MatchMeta{Host: "1.1.1.1"})) == "direct"
+	})
+}
+
+func TestRuleSetNeedResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("payload:\n  - '+.example.com'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewRuleProvider(RuleProviderConfig{Name: "set", Path: path, Format: RuleProviderFormat_YAML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pv := &FuncProvider{dns: newDNSCache(0, 0), ruleSets: map[string]*RuleProvider{"set": p}}
+	mp, err := NewRuleMapper([]any{
+		"rule-set: set, reject",
+		"ip-cidr: 10.0.0.0/8, direct",
+	}, RuleCacheConfig{}, pv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// a domain only set is not deferred, the host is not resolved
+	if d := mp.table.Load().deferred; len(d) != 1 || d[0] != 1 {
+		t.Fatalf("expect only the ip rule deferred, got %v", d)
+	}
+	resolved := 0
+	pv.setTracer(func(l LookupTrace) { resolved++ })
+	if HandlerName(mp.Match(MatchMeta{Host: "www.example.com"})) != "reject" {
+		t.Error("expect reject")
+	}
+	if resolved != 0 {
+		t.Errorf("expect no lookup, got %d", resolved)
+	}
+
+	// the set gains CIDR entries, the rule is deferred as well
+	if err := os.WriteFile(path, []byte("payload:\n  - '+.example.com'\n  - '1.1.1.0/24'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.reloadIfChanged()
+	if d := mp.table.Load().deferred; len(d) != 2 {
+		t.Fatalf("expect the rule set deferred after reload, got %v", d)
+	}
+	if HandlerName(mp.Match(MatchMeta{Host: "1.1.1.1"})) != "reject" {
+		t.Error("expect reject by the new cidr")
+	}
+}
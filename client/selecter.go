@@ -3,11 +3,30 @@ package client
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mengseeker/nlink/core/transform"
 )
 
-type Selecter func(remote *transform.Meta) (selected *ForwardClient, err error)
+// SelectMeta is the information of a connection used by selecters
+type SelectMeta struct {
+	Remote *transform.Meta
+
+	// client address, host:port
+	Source string
+
+	// members already tried by failover, never selected again
+	Exclude map[Forward]bool
+}
+
+type Selecter func(sm *SelectMeta) (selected Forward, err error)
 
 type SelecterType string
 
@@ -20,36 +39,442 @@ const (
 	SelecterType_LeastTTL          SelecterType = "leastttl"
 	SelecterType_LeastConnWeighted SelecterType = "leastconnweighted"
 	SelecterType_ConsistentHash    SelecterType = "consistenthash"
+	// member is chosen by user through the controller
+	SelecterType_Select SelecterType = "select"
 )
 
 type SelecterConfig struct {
 	Type SelecterType
+
+	// member name -> weight, default weight is 1
+	Weights map[string]int
+
+	// key of hash and consistenthash selecter, default is host
+	HashKey HashKeyType
+
+	// leastttl selecter keeps the current server unless another one is
+	// faster by more than Tolerance, default is DefaultLatencyTolerance
+	Tolerance time.Duration
+}
+
+const (
+	DefaultLatencyTolerance = 30 * time.Millisecond
+)
+
+type HashKeyType string
+
+const (
+	HashKeyType_Host     HashKeyType = "host"
+	HashKeyType_ETLD1    HashKeyType = "etld1"
+	HashKeyType_SourceIP HashKeyType = "src-ip"
+)
+
+// Weight returns the weight of the member, member names are matched
+// case-insensitively because config keys are lower cased by the loader.
+func (c SelecterConfig) Weight(name string) int {
+	w, ok := c.Weights[name]
+	if !ok {
+		for k, v := range c.Weights {
+			if strings.EqualFold(k, name) {
+				w, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return w
+}
+
+func (c SelecterConfig) Check(members []Forward) error {
+	for _, m := range members {
+		if w := c.Weight(m.Name()); w < 0 {
+			return fmt.Errorf("member %s weight must not be negative: %d", m.Name(), w)
+		}
+	}
+	switch c.HashKey {
+	case "", HashKeyType_Host, HashKeyType_ETLD1, HashKeyType_SourceIP:
+	default:
+		return fmt.Errorf("unsupport hash key %q", c.HashKey)
+	}
+	return nil
+}
+
+// HashKeyFunc returns a function to extract the hash key of a connection
+func (c SelecterConfig) HashKeyFunc() func(sm *SelectMeta) string {
+	switch c.HashKey {
+	case HashKeyType_ETLD1:
+		return func(sm *SelectMeta) string {
+			domain, _ := ParseHost(sm.Remote.Addr)
+			return EffectiveTLDPlusOne(domain)
+		}
+	case HashKeyType_SourceIP:
+		return func(sm *SelectMeta) string {
+			ip, _ := ParseHost(sm.Source)
+			return ip
+		}
+	default:
+		return func(sm *SelectMeta) string {
+			domain, _ := ParseHost(sm.Remote.Addr)
+			return domain
+		}
+	}
 }
 
-func NewSelecter(clients []*ForwardClient, selecterConfig SelecterConfig) (Selecter, error) {
+var (
+	ErrNoServerAvailable = errors.New("no server available")
+)
+
+func NewSelecter(members []Forward, selecterConfig SelecterConfig) (Selecter, error) {
+	if len(members) == 0 {
+		return nil, errors.New("selecter members must not empty")
+	}
+	if err := selecterConfig.Check(members); err != nil {
+		return nil, err
+	}
 	switch selecterConfig.Type {
 	case SelecterType_FrontFirst:
-		return NewFrontFirstSelecter(clients), nil
+		return NewFrontFirstSelecter(members), nil
 	case SelecterType_RoundRobin:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewRoundRobinSelecter(members, selecterConfig), nil
 	case SelecterType_Random:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewRandomSelecter(members, selecterConfig), nil
 	case SelecterType_Hash:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewHashSelecter(members, selecterConfig), nil
 	case SelecterType_LeastConn:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewLeastConnSelecter(members, SelecterConfig{Type: selecterConfig.Type}), nil
 	case SelecterType_LeastTTL:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewLeastTTLSelecter(members, selecterConfig)
 	case SelecterType_LeastConnWeighted:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewLeastConnSelecter(members, selecterConfig), nil
 	case SelecterType_ConsistentHash:
-		return nil, fmt.Errorf("selecter type %q not implemented", selecterConfig.Type)
+		return NewConsistentHashSelecter(members, selecterConfig), nil
+	case SelecterType_Select:
+		return NewManualSelecter("", members, nil).Select, nil
 	}
 	return nil, errors.New("not support selecter type: " + string(selecterConfig.Type))
 }
 
-func NewFrontFirstSelecter(clients []*ForwardClient) Selecter {
-	return func(remote *transform.Meta) (selected *ForwardClient, err error) {
-		return clients[0], nil
+// healthyIndexes returns the index of available members not excluded by sm,
+// all not excluded members are returned if none of them is available,
+// the health state may be wrong.
+func healthyIndexes(members []Forward, sm *SelectMeta) []int {
+	idxs := make([]int, 0, len(members))
+	for i, m := range members {
+		if m.Available() && !sm.Exclude[m] {
+			idxs = append(idxs, i)
+		}
+	}
+	if len(idxs) == 0 {
+		for i, m := range members {
+			if !sm.Exclude[m] {
+				idxs = append(idxs, i)
+			}
+		}
+	}
+	return idxs
+}
+
+func NewFrontFirstSelecter(members []Forward) Selecter {
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		idxs := healthyIndexes(members, sm)
+		if len(idxs) == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		return members[idxs[0]], nil
+	}
+}
+
+// NewRoundRobinSelecter returns a smooth weighted round-robin selecter,
+// servers with equal weights are selected in turn.
+func NewRoundRobinSelecter(members []Forward, cfg SelecterConfig) Selecter {
+	weights := make([]int, len(members))
+	for i, m := range members {
+		weights[i] = cfg.Weight(m.Name())
+	}
+	current := make([]int, len(members))
+	lock := sync.Mutex{}
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		idxs := healthyIndexes(members, sm)
+		lock.Lock()
+		defer lock.Unlock()
+		best, total := -1, 0
+		for _, i := range idxs {
+			current[i] += weights[i]
+			total += weights[i]
+			if best < 0 || current[i] > current[best] {
+				best = i
+			}
+		}
+		if total == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		current[best] -= total
+		return members[best], nil
+	}
+}
+
+// NewRandomSelecter returns a weighted random selecter
+func NewRandomSelecter(members []Forward, cfg SelecterConfig) Selecter {
+	weights := make([]int, len(members))
+	for i, m := range members {
+		weights[i] = cfg.Weight(m.Name())
+	}
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		idxs := healthyIndexes(members, sm)
+		total := 0
+		for _, i := range idxs {
+			total += weights[i]
+		}
+		if total == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		n := rand.Intn(total)
+		for _, i := range idxs {
+			if n < weights[i] {
+				return members[i], nil
+			}
+			n -= weights[i]
+		}
+		return members[idxs[len(idxs)-1]], nil
+	}
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// NewHashSelecter returns a selecter which always selects the same server
+// for the same key as long as the healthy servers are not changed.
+func NewHashSelecter(members []Forward, cfg SelecterConfig) Selecter {
+	weights := make([]int, len(members))
+	for i, m := range members {
+		weights[i] = cfg.Weight(m.Name())
+	}
+	keyFunc := cfg.HashKeyFunc()
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		idxs := healthyIndexes(members, sm)
+		total := 0
+		for _, i := range idxs {
+			total += weights[i]
+		}
+		if total == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		n := int(hashKey(keyFunc(sm)) % uint64(total))
+		for _, i := range idxs {
+			if n < weights[i] {
+				return members[i], nil
+			}
+			n -= weights[i]
+		}
+		return members[idxs[len(idxs)-1]], nil
+	}
+}
+
+// virtual nodes of each weight on the hash ring
+const ConsistentHashReplicas = 100
+
+type hashRingNode struct {
+	hash   uint64
+	member int
+}
+
+// NewConsistentHashSelecter returns a selecter based on a hash ring,
+// adding or removing a server only remaps the keys of its neighbour nodes.
+// Unhealthy servers are skipped by walking the ring to the next node.
+func NewConsistentHashSelecter(members []Forward, cfg SelecterConfig) Selecter {
+	ring := []hashRingNode{}
+	for i, m := range members {
+		replicas := cfg.Weight(m.Name()) * ConsistentHashReplicas
+		for r := 0; r < replicas; r++ {
+			ring = append(ring, hashRingNode{
+				hash:   hashKey(m.Name() + "#" + strconv.Itoa(r)),
+				member: i,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	keyFunc := cfg.HashKeyFunc()
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		if len(ring) == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		healthy := make([]bool, len(members))
+		for _, i := range healthyIndexes(members, sm) {
+			healthy[i] = true
+		}
+		h := hashKey(keyFunc(sm))
+		start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+		for n := 0; n < len(ring); n++ {
+			node := ring[(start+n)%len(ring)]
+			if healthy[node.member] {
+				return members[node.member], nil
+			}
+		}
+		return nil, ErrNoServerAvailable
+	}
+}
+
+// NewLeastConnSelecter returns a selecter which selects the server with
+// the fewest active streams divided by weight, ties are broken randomly.
+func NewLeastConnSelecter(members []Forward, cfg SelecterConfig) Selecter {
+	weights := make([]int, len(members))
+	for i, m := range members {
+		weights[i] = cfg.Weight(m.Name())
+	}
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		best := []int{}
+		bestConns, bestWeight := 0, 0
+		for _, i := range healthyIndexes(members, sm) {
+			if weights[i] == 0 {
+				continue
+			}
+			conns := members[i].ActiveConns()
+			if len(best) > 0 {
+				// conns/weight compared by cross multiplication
+				l, r := conns*bestWeight, bestConns*weights[i]
+				if l > r {
+					continue
+				}
+				if l < r {
+					best = best[:0]
+				}
+			}
+			if len(best) == 0 {
+				bestConns, bestWeight = conns, weights[i]
+			}
+			best = append(best, i)
+		}
+		if len(best) == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		return members[best[rand.Intn(len(best))]], nil
+	}
+}
+
+// NewLeastTTLSelecter returns a selecter which selects the server with
+// the lowest latency measured by health checks. To avoid flapping between
+// servers with similar latency, the current server is kept until another
+// one is faster by more than the tolerance.
+func NewLeastTTLSelecter(members []Forward, cfg SelecterConfig) (Selecter, error) {
+	for _, m := range members {
+		// latency of a group is measured by its members
+		if fc, ok := m.(*ForwardClient); ok && !fc.Config.HealthCheck.Enabled() {
+			return nil, fmt.Errorf("selecter %s requires health check of server %s", cfg.Type, m.Name())
+		}
+	}
+	tolerance := cfg.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultLatencyTolerance
+	}
+	var current atomic.Int32
+	return func(sm *SelectMeta) (selected Forward, err error) {
+		idxs := healthyIndexes(members, sm)
+		if len(idxs) == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		best := -1
+		for _, i := range idxs {
+			l := members[i].Latency()
+			if l == 0 {
+				continue
+			}
+			if best < 0 || l < members[best].Latency() {
+				best = i
+			}
+		}
+		if best < 0 {
+			// not measured yet
+			return members[idxs[0]], nil
+		}
+
+		cur := int(current.Load())
+		if cur == best {
+			return members[cur], nil
+		}
+		if members[cur].Available() && !sm.Exclude[members[cur]] {
+			if l := members[cur].Latency(); l != 0 && l-members[best].Latency() <= tolerance {
+				return members[cur], nil
+			}
+		}
+		if current.CompareAndSwap(int32(cur), int32(best)) {
+			logger.Infof("switch server %s(%s) -> %s(%s)",
+				members[cur].Name(), members[cur].Latency(),
+				members[best].Name(), members[best].Latency())
+		}
+		return members[best], nil
+	}, nil
+}
+
+// ManualSelecter always selects the member chosen by user, the choice is
+// saved to the store and restored when created.
+type ManualSelecter struct {
+	group    string
+	members  []Forward
+	store    *SelectStore
+	selected atomic.Int32
+	// serializes Set, so the saved member is the selected one
+	lock sync.Mutex
+}
+
+func NewManualSelecter(group string, members []Forward, store *SelectStore) *ManualSelecter {
+	s := &ManualSelecter{
+		group:   group,
+		members: members,
+		store:   store,
+	}
+	if name := store.Get(group); name != "" {
+		if i := s.index(name); i >= 0 {
+			s.selected.Store(int32(i))
+		} else {
+			logger.Warnf("group %s saved member %s not found, use %s", group, name, members[0].Name())
+		}
+	}
+	return s
+}
+
+func (s *ManualSelecter) index(name string) int {
+	for i, m := range s.members {
+		if m.Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *ManualSelecter) Select(sm *SelectMeta) (selected Forward, err error) {
+	m := s.Selected()
+	if sm.Exclude[m] {
+		return nil, ErrNoServerAvailable
+	}
+	return m, nil
+}
+
+func (s *ManualSelecter) Selected() Forward {
+	return s.members[s.selected.Load()]
+}
+
+// Set saves the member and changes the selected one, the selection is
+// not changed if saving failed.
+func (s *ManualSelecter) Set(name string) error {
+	i := s.index(name)
+	if i < 0 {
+		return fmt.Errorf("member %s not found in group %s", name, s.group)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.store.Set(s.group, name); err != nil {
+		return err
+	}
+	old := s.Selected()
+	s.selected.Store(int32(i))
+	if old.Name() != name {
+		logger.Infof("group %s select %s -> %s", s.group, old.Name(), name)
 	}
+	return nil
 }
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mengseeker/nlink/core/transform"
+)
+
+func newTestForwardClient(name string) *ForwardClient {
+	hc, _ := NewHealthChecker(name, HealthCheckConfig{}, nil)
+	return &ForwardClient{
+		Config:  ServerConfig{Name: name},
+		health:  hc,
+		breaker: NewCircuitBreaker(name, CircuitBreakerConfig{}),
+	}
+}
+
+func TestConsistentHashSelecter_Remap(t *testing.T) {
+	var clients []Forward
+	for i := 0; i < 5; i++ {
+		clients = append(clients, newTestForwardClient(fmt.Sprintf("server-%d", i)))
+	}
+	before := NewConsistentHashSelecter(clients, SelecterConfig{})
+	after := NewConsistentHashSelecter(clients[:4], SelecterConfig{})
+
+	keys, moved := 10000, 0
+	for i := 0; i < keys; i++ {
+		sm := &SelectMeta{Remote: &transform.Meta{Net: "tcp", Addr: fmt.Sprintf("host-%d.com:443", i)}}
+		a, _ := before(sm)
+		b, _ := after(sm)
+		if a != b {
+			moved++
+			if a != clients[4] {
+				t.Fatalf("key of %s remapped to %s", a.Name(), b.Name())
+			}
+		}
+	}
+	// about 1/5 keys belong to the removed server
+	if moved > keys/3 {
+		t.Fatalf("too many keys remapped: %d/%d", moved, keys)
+	}
+	t.Logf("remapped %d/%d keys", moved, keys)
+}
+
+func TestEffectiveTLDPlusOne(t *testing.T) {
+	cases := map[string]string{
+		"www.example.com":    "example.com",
+		"example.com":        "example.com",
+		"a.b.example.com.cn": "example.com.cn",
+		"www.bbc.co.uk":      "bbc.co.uk",
+		"a.foo.github.io":    "foo.github.io",
+		"www.naver.co.kr":    "naver.co.kr",
+		"localhost":          "localhost",
+		"1.2.3.4":            "1.2.3.4",
+	}
+	for host, want := range cases {
+		if got := EffectiveTLDPlusOne(host); got != want {
+			t.Errorf("EffectiveTLDPlusOne(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestWeightedSelecter_Distribution(t *testing.T) {
+	members := []Forward{newTestForwardClient("a"), newTestForwardClient("b"), newTestForwardClient("c")}
+	cfg := SelecterConfig{Weights: map[string]int{"a": 3, "b": 1, "c": 0}}
+
+	// smooth round-robin interleaves b with a instead of aaab
+	rr := NewRoundRobinSelecter(members, cfg)
+	var seq string
+	for i := 0; i < 8; i++ {
+		m, err := rr(&SelectMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq += m.Name()
+	}
+	if seq != "aabaaaba" {
+		t.Fatalf("round-robin sequence %s, want aabaaaba", seq)
+	}
+	random := NewRandomSelecter(members, cfg)
+	counts := map[string]int{}
+	n := 10000
+	for i := 0; i < n; i++ {
+		m, err := random(&SelectMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m.Name()]++
+	}
+	if counts["c"] != 0 {
+		t.Errorf("zero weight member selected %d times", counts["c"])
+	}
+	// expect 3/4 and 1/4
+	if a := float64(counts["a"]) / float64(n); a < 0.7 || a > 0.8 {
+		t.Errorf("weighted random distribution %v", counts)
+	}
+
+	zero := SelecterConfig{Weights: map[string]int{"a": 0, "b": 0, "c": 0}}
+	for name, sel := range map[string]Selecter{
+		"roundrobin": NewRoundRobinSelecter(members, zero),
+		"random":     NewRandomSelecter(members, zero),
+	} {
+		if _, err := sel(&SelectMeta{}); !errors.Is(err, ErrNoServerAvailable) {
+			t.Errorf("%s with all zero weights got err %v", name, err)
+		}
+	}
+}
+
+// metricForward reports the given latency, active conns and availability
+type metricForward struct {
+	fakeForward
+	latency time.Duration
+	conns   int
+	down    bool
+}
+
+func (f *metricForward) Available() bool        { return !f.down }
+func (f *metricForward) ActiveConns() int       { return f.conns }
+func (f *metricForward) Latency() time.Duration { return f.latency }
+
+func TestLeastTTLSelecter(t *testing.T) {
+	a := &metricForward{fakeForward: fakeForward{name: "a"}, latency: 100 * time.Millisecond}
+	b := &metricForward{fakeForward: fakeForward{name: "b"}, latency: 120 * time.Millisecond}
+	c := &metricForward{fakeForward: fakeForward{name: "c"}, latency: 150 * time.Millisecond}
+	sel, err := NewLeastTTLSelecter([]Forward{a, b, c}, SelecterConfig{Tolerance: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(sm *SelectMeta, want Forward) {
+		t.Helper()
+		got, err := sel(sm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("selected %s, want %s", got.Name(), want.Name())
+		}
+	}
+	expect(&SelectMeta{}, a)
+
+	// b is faster within the tolerance, stay on a
+	b.latency = 80 * time.Millisecond
+	expect(&SelectMeta{}, a)
+
+	// b is faster by more than the tolerance
+	b.latency = 60 * time.Millisecond
+	expect(&SelectMeta{}, b)
+	// a is back but within the tolerance, stay on b
+	a.latency = 40 * time.Millisecond
+	expect(&SelectMeta{}, b)
+
+	// unavailable and excluded members are skipped
+	b.down = true
+	expect(&SelectMeta{}, a)
+	b.down = false
+	expect(&SelectMeta{Exclude: map[Forward]bool{a: true, b: true}}, c)
+
+	// latency of a server is measured by health checks
+	fc := newTestForwardClient("d")
+	if _, err := NewLeastTTLSelecter([]Forward{a, fc}, SelecterConfig{}); err == nil {
+		t.Error("expect error of server without health check")
+	}
+	fc.Config.HealthCheck.Interval = time.Minute
+	if _, err := NewLeastTTLSelecter([]Forward{a, fc}, SelecterConfig{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeastConnSelecter(t *testing.T) {
+	a := &metricForward{fakeForward: fakeForward{name: "a"}, conns: 4}
+	b := &metricForward{fakeForward: fakeForward{name: "b"}, conns: 3}
+	c := &metricForward{fakeForward: fakeForward{name: "c"}, conns: 0}
+	sel := NewLeastConnSelecter([]Forward{a, b, c}, SelecterConfig{Weights: map[string]int{"a": 2, "c": 0}})
+	// a: 4/2 < b: 3/1, c has zero weight
+	if m, _ := sel(&SelectMeta{}); m != a {
+		t.Errorf("selected %s, want a", m.Name())
+	}
+	a.down = true
+	if m, _ := sel(&SelectMeta{}); m != b {
+		t.Errorf("selected %s, want b", m.Name())
+	}
+	if _, err := sel(&SelectMeta{Exclude: map[Forward]bool{b: true}}); !errors.Is(err, ErrNoServerAvailable) {
+		t.Errorf("expect ErrNoServerAvailable, got %v", err)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return fn(r) }
+
+func TestForwardClientActiveConns(t *testing.T) {
+	fc := newTestForwardClient("a")
+	fc.pool = newTestPool(ServerConfig{})
+	defer fc.pool.Close()
+
+	// an idle stream of the http transport is not active
+	conn, err := fc.dialHTTP("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fc.pool.ConnCount(); n != 1 {
+		t.Fatalf("expect 1 stream in the pool, got %d", n)
+	}
+	if n := fc.ActiveConns(); n != 0 {
+		t.Errorf("expect idle http stream not counted, got %d", n)
+	}
+
+	// a request is active until its body is closed
+	fc.httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})}
+	r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, err := fc.roundTrip(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fc.ActiveConns(); n != 1 {
+		t.Errorf("expect 1 in-flight request, got %d", n)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+	if n := fc.ActiveConns(); n != 0 {
+		t.Errorf("expect no in-flight request, got %d", n)
+	}
+
+	conn.Close()
+	if n := fc.pool.ConnCount(); n != 0 || fc.ActiveConns() != 0 {
+		t.Errorf("expect the stream put back, got %d", n)
+	}
+}
@@ -16,6 +16,16 @@ type SockesHandler interface {
 	HandleConn(net.Conn)
 }
 
+// setMetaSource fills the client address of meta
+func setMetaSource(meta *socks.Metadata, addr net.Addr) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	meta.SrcIP = net.ParseIP(host)
+	meta.SrcPort = port
+}
+
 type Socks4Handler struct {
 	mapper *RuleMapper
 }
@@ -27,6 +37,11 @@ func (h *Socks4Handler) HandleConn(conn net.Conn) {
 		return
 	}
 	meta := socks.ParseSocksAddr(socks5.ParseAddr(addr))
+	meta.Type = socks.SOCKS4
+	setMetaSource(meta, conn.RemoteAddr())
+	if h.mapper.NeedProcess() {
+		meta.ProcessPath = findProcessPath(meta.NetWork, meta.SrcIP, meta.SrcPort)
+	}
 	remote := transform.Meta{
 		Net:  "tcp",
 		Addr: meta.RemoteAddress(),
@@ -54,6 +69,11 @@ func (h *Socks5Handler) HandleConn(conn net.Conn) {
 		return
 	}
 	meta := socks.ParseSocksAddr(target)
+	meta.Type = socks.SOCKS5
+	setMetaSource(meta, conn.RemoteAddr())
+	if h.mapper.NeedProcess() {
+		meta.ProcessPath = findProcessPath(meta.NetWork, meta.SrcIP, meta.SrcPort)
+	}
 	remote := transform.Meta{
 		Net:  "tcp",
 		Addr: meta.RemoteAddress(),
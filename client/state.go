@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	DefaultStateFile = "nlink.state.json"
+)
+
+// SelectStore persists the members chosen by select groups
+type SelectStore struct {
+	path     string
+	lock     sync.Mutex
+	selected map[string]string
+}
+
+// LoadSelectStore loads the state file, a missing file is not an error
+func LoadSelectStore(path string) (*SelectStore, error) {
+	if path == "" {
+		path = DefaultStateFile
+	}
+	s := &SelectStore{
+		path:     path,
+		selected: map[string]string{},
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("read state file %s err: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &s.selected); err != nil {
+		return nil, fmt.Errorf("parse state file %s err: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *SelectStore) Get(group string) string {
+	if s == nil {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.selected[group]
+}
+
+// Set saves the selected member of group to the state file, the old
+// member is kept if saving failed.
+func (s *SelectStore) Set(group, member string) (err error) {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.selected[group]
+	s.selected[group] = member
+	defer func() {
+		if err == nil {
+			return
+		}
+		if ok {
+			s.selected[group] = old
+		} else {
+			delete(s.selected, group)
+		}
+	}()
+	raw, err := json.MarshalIndent(s.selected, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temp file and rename, the state file is never half written
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save state err: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save state err: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save state err: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("save state err: %v", err)
+	}
+	return nil
+}
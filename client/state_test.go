@@ -0,0 +1,54 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelectStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := LoadSelectStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("proxy", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadSelectStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get("proxy"); got != "b" {
+		t.Errorf("reloaded member %q, want b", got)
+	}
+
+	// the selection is restored by a new selecter
+	members := []Forward{newTestForwardClient("a"), newTestForwardClient("b")}
+	s := NewManualSelecter("proxy", members, reloaded)
+	if s.Selected().Name() != "b" {
+		t.Errorf("restored member %s, want b", s.Selected().Name())
+	}
+}
+
+func TestManualSelecterSaveError(t *testing.T) {
+	dir := t.TempDir()
+	store, err := LoadSelectStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := []Forward{newTestForwardClient("a"), newTestForwardClient("b")}
+	s := NewManualSelecter("proxy", members, store)
+
+	// saving fails once the directory is gone
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b"); err == nil {
+		t.Fatal("expect save error")
+	}
+	if s.Selected().Name() != "a" || store.Get("proxy") != "" {
+		t.Errorf("selection changed after save error: %s, stored %q", s.Selected().Name(), store.Get("proxy"))
+	}
+}
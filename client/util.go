@@ -2,29 +2,38 @@ package client
 
 import (
 	"crypto/tls"
+	"net"
 	"strings"
+
+	"golang.org/x/net/publicsuffix"
 )
 
+// ParseHost splits "host[:port]", host may be a bracketed or bare IPv6
+// address, the brackets are removed.
 func ParseHost(host string) (domain, port string) {
-	if host == "" {
-		return
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return h, p
+	}
+	// no port
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1], ""
 	}
-	domain = host
-	if host[0] == ':' || host[0] == '[' {
-		bs := strings.Split(host, "]")
-		if len(bs) < 2 || len(bs[0]) < 2 || len(bs[1]) < 2 {
-			return
-		}
-		domain = strings.TrimPrefix(bs[0], "[")
-		port = strings.TrimPrefix(bs[1], ":")
-		return
+	return host, ""
+}
+
+// EffectiveTLDPlusOne returns the registrable domain of host by the
+// public suffix list, e.g. "www.example.com.cn" -> "example.com.cn".
+// IP addresses and hosts without one are returned as is.
+func EffectiveTLDPlusOne(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
 	}
-	bs := strings.Split(host, ":")
-	domain = bs[0]
-	if len(bs) > 1 {
-		port = bs[1]
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
 	}
-	return
+	return domain
 }
 
 func NewClientTls(certFile, keyFile string) (tc *tls.Config, err error) {
@@ -4,6 +4,10 @@ Copyright © 2022 mengseeker@yeah.net
 package cmd
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/mengseeker/nlink/client"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -27,7 +31,19 @@ to quickly create a Cobra application.`,
 func runClient() {
 	var cfg client.ProxyConfig
 	cobra.CheckErr(viper.UnmarshalKey("client", &cfg))
-	cobra.CheckErr(client.Start(cfg))
+	c, err := client.NewClient(cfg)
+	cobra.CheckErr(err)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	closed := make(chan error, 1)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		closed <- c.Close()
+	}()
+	cobra.CheckErr(c.ListenAndServe())
+	cobra.CheckErr(<-closed)
 }
 
 func init() {
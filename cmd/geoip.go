@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 mengseeker@yeah.net
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mengseeker/nlink/client"
+	"github.com/mengseeker/nlink/core/geoip"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// geoipCmd represents the geoip command
+var geoipCmd = &cobra.Command{
+	Use:   "geoip",
+	Short: "Query the geoip databases",
+}
+
+// geoipInfoCmd represents the geoip info command
+var geoipInfoCmd = &cobra.Command{
+	Use:   "info ip",
+	Short: "Show the country and ASN of ip",
+	Long: `Show the country and ASN of ip from the databases configured in
+client.GeoIP, the embedded country database is used if not configured.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runGeoIPInfo(args[0])
+	},
+}
+
+func runGeoIPInfo(addr string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		cobra.CheckErr(fmt.Errorf("invalid ip: %s", addr))
+	}
+	var cfg client.ProxyConfig
+	cobra.CheckErr(viper.UnmarshalKey("client", &cfg))
+	db, err := geoip.Open(cfg.GeoIP)
+	cobra.CheckErr(err)
+	defer db.Close()
+
+	fmt.Printf("ip: %s\n", ip)
+	fmt.Printf("country: %s\n", db.Country(ip))
+	number, org, err := db.ASN(ip)
+	switch {
+	case errors.Is(err, geoip.ErrNoASNDB):
+		fmt.Printf("asn: %v\n", err)
+	case err != nil:
+		cobra.CheckErr(err)
+	default:
+		fmt.Printf("asn: %d %s\n", number, org)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(geoipCmd)
+	geoipCmd.AddCommand(geoipInfoCmd)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 mengseeker@yeah.net
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mengseeker/nlink/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	explainInbound string
+	explainNetwork string
+	explainSrcIP   string
+)
+
+// ruleCmd represents the rule command
+var ruleCmd = &cobra.Command{
+	Use:   "rule",
+	Short: "Inspect the client rules",
+}
+
+// explainCmd represents the rule explain command
+var explainCmd = &cobra.Command{
+	Use:   "explain host [port]",
+	Short: "Show how the client rules route a connection",
+	Long: `Load the client rules from config and show each rule evaluated for
+a connection to host:port, with the DNS and GeoIP lookups done and the
+handler finally chosen. No server is connected. For example:
+
+  nlink rule explain example.com
+  nlink rule explain 1.1.1.1 53 --inbound http --src-ip 192.168.1.100`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runExplain(args)
+	},
+}
+
+func runExplain(args []string) {
+	var cfg client.ProxyConfig
+	cobra.CheckErr(viper.UnmarshalKey("client", &cfg))
+	port := "443"
+	if len(args) > 1 {
+		port = args[1]
+	}
+	mm, err := client.NewMatchMeta(args[0], port, explainInbound, explainNetwork, explainSrcIP)
+	cobra.CheckErr(err)
+
+	mapper, pv, err := client.NewExplainMapper(cfg)
+	cobra.CheckErr(err)
+	defer pv.Close()
+	defer mapper.Close()
+
+	exp := mapper.Explain(mm)
+	for _, step := range exp.Steps {
+		fmt.Printf("rule %d: %s\n", step.Index, step.Rule)
+		for _, l := range step.Lookups {
+			fmt.Printf("  %s %s -> %s\n", l.Kind, l.Query, l.Result)
+		}
+		fmt.Printf("  matched: %v\n", step.Matched)
+	}
+	if exp.Matched == 0 {
+		fmt.Printf("result: no rule matched, %s\n", exp.Handler)
+		return
+	}
+	fmt.Printf("result: rule %d, %s\n", exp.Matched, exp.Handler)
+}
+
+func init() {
+	rootCmd.AddCommand(ruleCmd)
+	ruleCmd.AddCommand(explainCmd)
+
+	explainCmd.Flags().StringVar(&explainInbound, "inbound", "socks5", "inbound type: http, https-connect, socks4, socks5")
+	explainCmd.Flags().StringVar(&explainNetwork, "network", "tcp", "network, tcp or udp, proxied traffic is always tcp")
+	explainCmd.Flags().StringVar(&explainSrcIP, "src-ip", "", "client IP")
+}
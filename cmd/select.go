@@ -0,0 +1,85 @@
+/*
+Copyright © 2022 mengseeker@yeah.net
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mengseeker/nlink/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	controllerAddr   string
+	controllerSecret string
+)
+
+// selectCmd represents the select command
+var selectCmd = &cobra.Command{
+	Use:   "select [group] [member]",
+	Short: "Show groups or change the member of a select group",
+	Long: `Show groups or change the member of a select group of a running client
+through its controller api. For example:
+
+  nlink client select                 # list all groups
+  nlink client select proxy           # show group proxy
+  nlink client select proxy tokyo     # use tokyo in group proxy`,
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSelect(args)
+	},
+}
+
+func newControllerClient() *client.ControllerClient {
+	addr := controllerAddr
+	if addr == "" {
+		addr = viper.GetString("client.controller")
+	}
+	if addr == "" {
+		cobra.CheckErr(errors.New("client controller address is not configured"))
+	}
+	secret := controllerSecret
+	if secret == "" {
+		secret = viper.GetString("client.controllersecret")
+	}
+	return client.NewControllerClient(addr, secret)
+}
+
+func runSelect(args []string) {
+	ctl := newControllerClient()
+
+	switch len(args) {
+	case 0:
+		infos, err := ctl.Groups()
+		cobra.CheckErr(err)
+		for _, info := range infos {
+			printGroupInfo(info)
+		}
+	case 1:
+		info, err := ctl.Group(args[0])
+		cobra.CheckErr(err)
+		printGroupInfo(info)
+	default:
+		info, err := ctl.Select(args[0], args[1])
+		cobra.CheckErr(err)
+		printGroupInfo(info)
+	}
+}
+
+func printGroupInfo(info client.GroupInfo) {
+	fmt.Printf("%s (%s): %s\n", info.Name, info.Type, strings.Join(info.Members, ", "))
+	if info.Selected != "" {
+		fmt.Printf("  selected: %s\n", info.Selected)
+	}
+}
+
+func init() {
+	clientCmd.AddCommand(selectCmd)
+
+	clientCmd.PersistentFlags().StringVar(&controllerAddr, "controller", "", "controller address (default is client.Controller in config)")
+	clientCmd.PersistentFlags().StringVar(&controllerSecret, "secret", "", "controller secret (default is client.ControllerSecret in config)")
+}
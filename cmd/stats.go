@@ -0,0 +1,42 @@
+/*
+Copyright © 2022 mengseeker@yeah.net
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mengseeker/nlink/client"
+	"github.com/spf13/cobra"
+)
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show statistics of a running client",
+	Long: `Show health, circuit breaker and connection pool statistics of
+the servers, and matches and traffic of the rules of a running client
+through its controller api.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runStats()
+	},
+}
+
+func runStats() {
+	ctl := newControllerClient()
+	servers, err := ctl.Servers()
+	cobra.CheckErr(err)
+	rules, err := ctl.Rules()
+	cobra.CheckErr(err)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	cobra.CheckErr(encoder.Encode(struct {
+		Servers []client.ServerInfo
+		Rules   client.RulesInfo
+	}{servers, rules}))
+}
+
+func init() {
+	clientCmd.AddCommand(statsCmd)
+}
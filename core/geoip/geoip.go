@@ -3,9 +3,16 @@ package geoip
 import (
 	"bytes"
 	_ "embed"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mengseeker/nlink/core/log"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/xi2/xz"
 )
@@ -13,25 +20,204 @@ import (
 //go:embed Country.mmdb.xz
 var dbBytes []byte
 
-var db *geoip2.Reader
+var logger = log.NewLogger()
 
-func InitDB() (err error) {
+const (
+	DefaultReloadInterval = time.Minute
+)
+
+var (
+	ErrNoASNDB = errors.New("ASN database is not configured")
+)
+
+type Config struct {
+	// MaxMind format country database, the embedded one is used if empty
+	Country string
+	// MaxMind format ASN database, ASN lookup is unavailable if empty
+	ASN string
+	// interval of checking file changes, default is DefaultReloadInterval
+	Interval time.Duration
+}
+
+// dbFile is a database loaded from file, reloaded when the file is changed
+type dbFile struct {
+	path    string
+	reader  atomic.Pointer[geoip2.Reader]
+	modTime time.Time
+	size    int64
+}
+
+func (f *dbFile) load() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	// read into memory instead of mmap, so the old reader can be dropped
+	// while lookups are running
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	r, err := geoip2.FromBytes(raw)
+	if err != nil {
+		return fmt.Errorf("load geoip database %s err: %v", f.path, err)
+	}
+	f.reader.Store(r)
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// reloadIfChanged reports whether the file is changed and reloaded
+func (f *dbFile) reloadIfChanged() bool {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		logger.Warnf("stat geoip database %s err: %v", f.path, err)
+		return false
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false
+	}
+	if err := f.load(); err != nil {
+		// keep the old database, retried when the file changes again
+		f.modTime, f.size = fi.ModTime(), fi.Size()
+		logger.Errorf("reload %v", err)
+		return false
+	}
+	logger.Infof("geoip database %s reloaded", f.path)
+	return true
+}
+
+type DB struct {
+	country *dbFile
+	asn     *dbFile
+	// embedded country database, nil if Config.Country is set
+	embedded *geoip2.Reader
+
+	lock     sync.Mutex
+	onReload []func()
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Open loads the databases and watches the files, the embedded country
+// database is decompressed only if Config.Country is empty.
+func Open(cfg Config) (*DB, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultReloadInterval
+	}
+	db := &DB{done: make(chan struct{})}
+	var files []*dbFile
+	if cfg.Country != "" {
+		db.country = &dbFile{path: cfg.Country}
+		files = append(files, db.country)
+	} else {
+		r, err := openEmbedded()
+		if err != nil {
+			return nil, err
+		}
+		db.embedded = r
+	}
+	if cfg.ASN != "" {
+		db.asn = &dbFile{path: cfg.ASN}
+		files = append(files, db.asn)
+	}
+	for _, f := range files {
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) > 0 {
+		go db.watch(files, cfg.Interval)
+	}
+	return db, nil
+}
+
+func openEmbedded() (*geoip2.Reader, error) {
 	r, err := xz.NewReader(bytes.NewReader(dbBytes), 0)
 	if err != nil {
-		return
+		return nil, err
 	}
 	raw, err := io.ReadAll(r)
 	if err != nil {
-		return
+		return nil, err
 	}
-	db, err = geoip2.FromBytes(raw)
-	return
+	return geoip2.FromBytes(raw)
 }
 
-func Country(ip net.IP) string {
-	c, _ := db.Country(ip)
+func (db *DB) watch(files []*dbFile, interval time.Duration) {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			reloaded := false
+			for _, f := range files {
+				if f.reloadIfChanged() {
+					reloaded = true
+				}
+			}
+			if reloaded {
+				db.lock.Lock()
+				fns := db.onReload
+				db.lock.Unlock()
+				for _, fn := range fns {
+					fn()
+				}
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// OnReload registers fn called after a database file is reloaded
+func (db *DB) OnReload(fn func()) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.onReload = append(db.onReload, fn)
+}
+
+func (db *DB) countryReader() *geoip2.Reader {
+	if db.country != nil {
+		return db.country.reader.Load()
+	}
+	return db.embedded
+}
+
+// Country returns the ISO code of the country of ip, empty if unknown
+func (db *DB) Country(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	c, _ := db.countryReader().Country(ip)
 	if c != nil {
 		return c.Country.IsoCode
 	}
 	return ""
 }
+
+func (db *DB) HasASN() bool {
+	return db.asn != nil
+}
+
+// ASN returns the autonomous system number and organization of ip,
+// number is 0 if unknown
+func (db *DB) ASN(ip net.IP) (number uint, org string, err error) {
+	if db.asn == nil {
+		return 0, "", ErrNoASNDB
+	}
+	if ip == nil {
+		return 0, "", nil
+	}
+	a, err := db.asn.reader.Load().ASN(ip)
+	if err != nil {
+		return 0, "", err
+	}
+	return a.AutonomousSystemNumber, a.AutonomousSystemOrganization, nil
+}
+
+// Close stops watching the files
+func (db *DB) Close() error {
+	db.stopOnce.Do(func() { close(db.done) })
+	return nil
+}
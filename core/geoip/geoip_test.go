@@ -0,0 +1,143 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mengseeker/nlink/core/geoip/geoiptest"
+)
+
+func TestOpenEmbedded(t *testing.T) {
+	db, err := Open(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if c := db.Country(net.ParseIP("114.114.114.114")); c != "CN" {
+		t.Errorf("got country %q", c)
+	}
+	if c := db.Country(nil); c != "" {
+		t.Errorf("got country %q of nil ip", c)
+	}
+	if _, _, err := db.ASN(net.ParseIP("1.1.1.1")); !errors.Is(err, ErrNoASNDB) {
+		t.Errorf("expect ErrNoASNDB, got %v", err)
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	if _, err := Open(Config{Country: "not-exist.mmdb"}); err == nil {
+		t.Error("expect error")
+	}
+}
+
+func writeCountry(t *testing.T, path, iso string) {
+	err := geoiptest.Write(path, "GeoLite2-Country", map[string]any{
+		"1.1.1.0/24": map[string]any{"country": map[string]any{"iso_code": iso}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenASN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	err := geoiptest.Write(path, "GeoLite2-ASN", map[string]any{
+		"1.1.1.0/24": map[string]any{
+			"autonomous_system_number":       uint32(13335),
+			"autonomous_system_organization": "CLOUDFLARENET",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	countryPath := filepath.Join(t.TempDir(), "country.mmdb")
+	writeCountry(t, countryPath, "US")
+	db, err := Open(Config{Country: countryPath, ASN: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	number, org, err := db.ASN(net.ParseIP("1.1.1.1"))
+	if err != nil || number != 13335 || org != "CLOUDFLARENET" {
+		t.Errorf("got %d %q %v", number, org, err)
+	}
+	if number, _, _ := db.ASN(net.ParseIP("8.8.8.8")); number != 0 {
+		t.Errorf("got %d of unknown ip", number)
+	}
+}
+
+func TestReloadIfChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeCountry(t, path, "US")
+	db, err := Open(Config{Country: path, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	f := db.country
+	if f.reloadIfChanged() {
+		t.Error("expect no reload of unchanged file")
+	}
+
+	// same size, only the time is changed
+	writeCountry(t, path, "JP")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !f.reloadIfChanged() {
+		t.Fatal("expect reloaded")
+	}
+	if c := db.Country(net.ParseIP("1.1.1.1")); c != "JP" {
+		t.Errorf("got country %q", c)
+	}
+
+	// an invalid file keeps the old database and is not retried
+	if err := os.WriteFile(path, []byte("invalid"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if f.reloadIfChanged() {
+		t.Error("expect invalid file not reloaded")
+	}
+	if c := db.Country(net.ParseIP("1.1.1.1")); c != "JP" {
+		t.Errorf("got country %q", c)
+	}
+	if fi, _ := os.Stat(path); !f.modTime.Equal(fi.ModTime()) || f.size != fi.Size() {
+		t.Error("expect the invalid file recorded")
+	}
+}
+
+func TestOnReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeCountry(t, path, "US")
+	db, err := Open(Config{Country: path, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reloaded := make(chan struct{}, 1)
+	db.OnReload(func() {
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+	})
+
+	writeCountry(t, path, "JP")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect OnReload called")
+	}
+	if c := db.Country(net.ParseIP("1.1.1.1")); c != "JP" {
+		t.Errorf("got country %q", c)
+	}
+}
@@ -0,0 +1,219 @@
+// Package geoiptest writes small MaxMind databases for tests.
+package geoiptest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+)
+
+const (
+	recordSize    = 32
+	metadataStart = "\xAB\xCD\xEFMaxMind.com"
+)
+
+type node struct {
+	children [2]*node
+	// record of a leaf, nil for inner nodes
+	data []byte
+	id   int
+}
+
+// Write writes an IPv4 MaxMind database of dbType to path, networks maps
+// CIDRs to their records, e.g.
+//
+//	geoiptest.Write(path, "GeoLite2-ASN", map[string]any{
+//		"1.1.1.0/24": map[string]any{
+//			"autonomous_system_number":       uint32(13335),
+//			"autonomous_system_organization": "CLOUDFLARENET",
+//		},
+//	})
+//
+// Records may be strings, uint16, uint32, uint64, []string and
+// map[string]any of them. Networks must not overlap.
+func Write(path, dbType string, networks map[string]any) error {
+	root := &node{}
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ip := ipnet.IP.To4()
+		ones, _ := ipnet.Mask.Size()
+		if ip == nil || ones == 0 {
+			return fmt.Errorf("unsupported network %s", cidr)
+		}
+		data, err := encode(nil, networks[cidr])
+		if err != nil {
+			return err
+		}
+		n := root
+		for i := 0; i < ones; i++ {
+			if n.data != nil {
+				return fmt.Errorf("network %s overlaps", cidr)
+			}
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &node{}
+			}
+			n = n.children[bit]
+		}
+		if n.data != nil || n.children != [2]*node{} {
+			return fmt.Errorf("network %s overlaps", cidr)
+		}
+		n.data = data
+	}
+
+	// number inner nodes in BFS order, the root is 0
+	var inner []*node
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data != nil {
+			continue
+		}
+		n.id = len(inner)
+		inner = append(inner, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := len(inner)
+
+	var tree, section []byte
+	offsets := map[*node]int{}
+	record := func(c *node) uint32 {
+		switch {
+		case c == nil:
+			return uint32(nodeCount)
+		case c.data == nil:
+			return uint32(c.id)
+		}
+		off, ok := offsets[c]
+		if !ok {
+			off = len(section)
+			offsets[c] = off
+			section = append(section, c.data...)
+		}
+		return uint32(nodeCount + 16 + off)
+	}
+	for _, n := range inner {
+		tree = binary.BigEndian.AppendUint32(tree, record(n.children[0]))
+		tree = binary.BigEndian.AppendUint32(tree, record(n.children[1]))
+	}
+
+	metadata, err := encode(nil, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               dbType,
+		"description":                 map[string]any{"en": "test database"},
+		"ip_version":                  uint16(4),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+	if err != nil {
+		return err
+	}
+	raw := append(tree, make([]byte, 16)...)
+	raw = append(raw, section...)
+	raw = append(raw, metadataStart...)
+	raw = append(raw, metadata...)
+	return os.WriteFile(path, raw, 0o644)
+}
+
+// data types of the MaxMind DB format
+const (
+	typeString = 2
+	typeUint16 = 5
+	typeUint32 = 6
+	typeMap    = 7
+	typeUint64 = 9
+	typeArray  = 11
+)
+
+func appendControl(b []byte, typ, size int) ([]byte, error) {
+	if size >= 29+256 {
+		return nil, fmt.Errorf("size %d is too large", size)
+	}
+	sizeBits, extra := size, []byte(nil)
+	if size >= 29 {
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	}
+	if typ > 7 {
+		b = append(b, byte(sizeBits), byte(typ-7))
+	} else {
+		b = append(b, byte(typ<<5|sizeBits))
+	}
+	return append(b, extra...), nil
+}
+
+func appendUint(b []byte, typ int, v uint64) ([]byte, error) {
+	raw := binary.BigEndian.AppendUint64(nil, v)
+	for len(raw) > 0 && raw[0] == 0 {
+		raw = raw[1:]
+	}
+	b, err := appendControl(b, typ, len(raw))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, raw...), nil
+}
+
+func encode(b []byte, v any) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case string:
+		if b, err = appendControl(b, typeString, len(v)); err != nil {
+			return nil, err
+		}
+		return append(b, v...), nil
+	case uint16:
+		return appendUint(b, typeUint16, uint64(v))
+	case uint32:
+		return appendUint(b, typeUint32, uint64(v))
+	case uint64:
+		return appendUint(b, typeUint64, v)
+	case []string:
+		if b, err = appendControl(b, typeArray, len(v)); err != nil {
+			return nil, err
+		}
+		for _, s := range v {
+			if b, err = encode(b, s); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		if b, err = appendControl(b, typeMap, len(v)); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if b, err = encode(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = encode(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %T", v)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build geosite_embed
+
+package geosite
+
+import (
+	"bytes"
+	_ "embed"
+	"io"
+
+	"github.com/xi2/xz"
+)
+
+// downloaded by "make geosite" before building with tag geosite_embed,
+// any geosite.dat compressed by xz works
+//
+//go:embed geosite.dat.xz
+var dbBytes []byte
+
+// Embedded decompresses the embedded database
+func Embedded() (*DB, error) {
+	r, err := xz.NewReader(bytes.NewReader(dbBytes), 0)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(raw)
+}
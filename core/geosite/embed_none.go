@@ -0,0 +1,9 @@
+//go:build !geosite_embed
+
+package geosite
+
+// Embedded returns ErrNotEmbedded, the database is embedded only when
+// built with tag geosite_embed
+func Embedded() (*DB, error) {
+	return nil, ErrNotEmbedded
+}
@@ -0,0 +1,15 @@
+//go:build geosite_embed
+
+package geosite
+
+import "testing"
+
+func TestEmbedded(t *testing.T) {
+	db, err := Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Codes()) == 0 {
+		t.Error("expect categories in the embedded database")
+	}
+}
@@ -0,0 +1,231 @@
+// Package geosite reads v2ray geosite.dat, a protobuf GeoSiteList of
+// domain categories.
+package geosite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type DomainType int
+
+const (
+	// the value is a keyword of the domain
+	DomainType_Plain DomainType = iota
+	// the value is a regexp
+	DomainType_Regex
+	// the domain and its subdomains
+	DomainType_Domain
+	// the domain only
+	DomainType_Full
+)
+
+type Domain struct {
+	Type  DomainType
+	Value string
+	Attrs map[string]bool
+}
+
+type DB struct {
+	sites map[string][]Domain
+}
+
+var (
+	ErrNotEmbedded = errors.New("geosite database is not embedded, build with tag geosite_embed")
+	errTruncated   = errors.New("truncated geosite data")
+)
+
+// Load reads a geosite.dat file
+func Load(path string) (*DB, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse geosite %s err: %v", path, err)
+	}
+	return db, nil
+}
+
+// Parse decodes the protobuf messages:
+//
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	message Attribute { string key = 1; oneof typed_value { bool bool_value = 2; int64 int_value = 3; } }
+func Parse(raw []byte) (*DB, error) {
+	db := &DB{sites: map[string][]Domain{}}
+	err := walkMessage(raw, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		code, domains, err := parseSite(value)
+		if err != nil {
+			return err
+		}
+		code = strings.ToLower(code)
+		db.sites[code] = append(db.sites[code], domains...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func parseSite(raw []byte) (code string, domains []Domain, err error) {
+	err = walkMessage(raw, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			code = string(value)
+		case 2:
+			d, err := parseDomain(value)
+			if err != nil {
+				return err
+			}
+			domains = append(domains, d)
+		}
+		return nil
+	})
+	return
+}
+
+func parseDomain(raw []byte) (d Domain, err error) {
+	err = walkMessage(raw, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			t, _, err := readVarint(value)
+			if err != nil {
+				return err
+			}
+			d.Type = DomainType(t)
+		case 2:
+			d.Value = string(value)
+		case 3:
+			var key string
+			err := walkMessage(value, func(field int, value []byte) error {
+				if field == 1 {
+					key = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if d.Attrs == nil {
+				d.Attrs = map[string]bool{}
+			}
+			d.Attrs[strings.ToLower(key)] = true
+		}
+		return nil
+	})
+	// regexps are case sensitive, \D is not \d
+	if d.Type != DomainType_Regex {
+		d.Value = strings.ToLower(d.Value)
+	}
+	return
+}
+
+// walkMessage calls fn with every field of a protobuf message, value is the
+// payload of length delimited fields or the varint bytes.
+func walkMessage(raw []byte, fn func(field int, value []byte) error) error {
+	for len(raw) > 0 {
+		tag, n, err := readVarint(raw)
+		if err != nil {
+			return err
+		}
+		raw = raw[n:]
+		field, wireType := int(tag>>3), tag&7
+		var value []byte
+		switch wireType {
+		case 0: // varint
+			_, n, err := readVarint(raw)
+			if err != nil {
+				return err
+			}
+			value, raw = raw[:n], raw[n:]
+		case 1: // 64-bit
+			if len(raw) < 8 {
+				return errTruncated
+			}
+			value, raw = raw[:8], raw[8:]
+		case 2: // length delimited
+			l, n, err := readVarint(raw)
+			if err != nil {
+				return err
+			}
+			raw = raw[n:]
+			if uint64(len(raw)) < l {
+				return errTruncated
+			}
+			value, raw = raw[:l], raw[l:]
+		case 5: // 32-bit
+			if len(raw) < 4 {
+				return errTruncated
+			}
+			value, raw = raw[:4], raw[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err := fn(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readVarint(b []byte) (v uint64, n int, err error) {
+	for shift := uint(0); n < len(b) && shift < 64; shift += 7 {
+		c := b[n]
+		n++
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, n, nil
+		}
+	}
+	return 0, 0, errTruncated
+}
+
+// Domains returns the domains of category code, filtered by attrs. An attr
+// "ads" selects domains with attribute ads, "!ads" selects domains without it.
+func (db *DB) Domains(code string, attrs ...string) ([]Domain, bool) {
+	all, ok := db.sites[strings.ToLower(code)]
+	if !ok || len(attrs) == 0 {
+		return all, ok
+	}
+	var domains []Domain
+	for _, d := range all {
+		if matchAttrs(d, attrs) {
+			domains = append(domains, d)
+		}
+	}
+	return domains, true
+}
+
+func matchAttrs(d Domain, attrs []string) bool {
+	for _, a := range attrs {
+		a = strings.ToLower(a)
+		if name, ok := strings.CutPrefix(a, "!"); ok {
+			if d.Attrs[name] {
+				return false
+			}
+		} else if !d.Attrs[a] {
+			return false
+		}
+	}
+	return true
+}
+
+// Codes returns the sorted category codes
+func (db *DB) Codes() []string {
+	codes := make([]string, 0, len(db.sites))
+	for c := range db.sites {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
@@ -0,0 +1,62 @@
+package geosite
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func field(num int, value []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(num<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func varintField(num int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(num<<3))
+	return binary.AppendUvarint(b, v)
+}
+
+func domain(t DomainType, value string, attrs ...string) []byte {
+	b := append(varintField(1, uint64(t)), field(2, []byte(value))...)
+	for _, a := range attrs {
+		b = append(b, field(3, append(field(1, []byte(a)), varintField(2, 1)...))...)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	site := field(1, []byte("CN"))
+	site = append(site, field(2, domain(DomainType_Domain, "baidu.com"))...)
+	site = append(site, field(2, domain(DomainType_Full, "www.qq.com", "ads"))...)
+	site = append(site, field(2, domain(DomainType_Plain, "TaoBao"))...)
+	site = append(site, field(2, domain(DomainType_Regex, `^\D+\.Example\.com$`))...)
+	db, err := Parse(field(1, site))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, ok := db.Domains("cn")
+	if !ok || len(all) != 4 {
+		t.Fatalf("got %v", all)
+	}
+	if all[1].Type != DomainType_Full || all[1].Value != "www.qq.com" || !all[1].Attrs["ads"] {
+		t.Errorf("got %+v", all[1])
+	}
+	if all[2].Value != "taobao" {
+		t.Errorf("got %+v", all[2])
+	}
+	if all[3].Type != DomainType_Regex || all[3].Value != `^\D+\.Example\.com$` {
+		t.Errorf("regexp value changed: %+v", all[3])
+	}
+	if ads, _ := db.Domains("cn", "ads"); len(ads) != 1 {
+		t.Errorf("got %v", ads)
+	}
+	if notAds, _ := db.Domains("cn", "!ads"); len(notAds) != 3 {
+		t.Errorf("got %v", notAds)
+	}
+	if _, ok := db.Domains("us"); ok {
+		t.Error("expect not found")
+	}
+	if _, err := Parse(field(1, site)[:10]); err == nil {
+		t.Error("expect truncated error")
+	}
+}
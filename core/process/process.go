@@ -0,0 +1,17 @@
+package process
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrNotSupported = errors.New("process lookup is not supported on this platform")
+	ErrNotFound     = errors.New("process not found")
+)
+
+// FindProcessPath returns the executable path of the local process owning
+// the connection from srcIP:srcPort. network is "tcp" or "udp".
+func FindProcessPath(network string, srcIP net.IP, srcPort int) (string, error) {
+	return findProcessPath(network, srcIP, srcPort)
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func findProcessPath(network string, srcIP net.IP, srcPort int) (string, error) {
+	inode, err := findSocketInode(network, srcIP, srcPort)
+	if err != nil {
+		return "", err
+	}
+	return findProcessByInode(inode)
+}
+
+// findSocketInode searches /proc/net/{tcp,tcp6} for the socket whose local
+// address is ip:port
+func findSocketInode(network string, ip net.IP, port int) (string, error) {
+	for _, file := range []string{"/proc/net/" + network, "/proc/net/" + network + "6"} {
+		inode, err := searchSocketTable(file, ip, port)
+		if err != nil {
+			return "", err
+		}
+		if inode != "" {
+			return inode, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func searchSocketTable(file string, ip net.IP, port int) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localIP, localPort, err := parseSocketAddr(fields[1])
+		if err != nil || localPort != port || !localIP.Equal(ip) {
+			continue
+		}
+		if fields[9] == "0" {
+			// time wait sockets have no owner
+			continue
+		}
+		return fields[9], nil
+	}
+	return "", scanner.Err()
+}
+
+// parseSocketAddr parses "0100007F:1F90", the IP is printed as hex of 32 bits
+// words in host byte order
+func parseSocketAddr(s string) (net.IP, int, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid socket address %q", s)
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid socket address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(raw[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid socket address %q", s)
+	}
+	return net.IP(raw), int(port), nil
+}
+
+// findProcessByInode finds the process holding the socket fd
+func findProcessByInode(inode string) (string, error) {
+	target := "socket:[" + inode + "]"
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+	for _, p := range procs {
+		if _, err := strconv.Atoi(p.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// process exited or permission denied
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || link != target {
+				continue
+			}
+			return os.Readlink(filepath.Join("/proc", p.Name(), "exe"))
+		}
+	}
+	return "", ErrNotFound
+}
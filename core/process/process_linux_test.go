@@ -0,0 +1,56 @@
+//go:build linux
+
+package process
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseSocketAddr(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("addresses below are printed by a little-endian kernel")
+	}
+	ip, port, err := parseSocketAddr("0100007F:1F90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("127.0.0.1")) || port != 8080 {
+		t.Errorf("got %s:%d", ip, port)
+	}
+	ip, _, err = parseSocketAddr("0000000000000000FFFF00000100007F:0050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got %s", ip)
+	}
+}
+
+func TestFindProcessPath(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc: ", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	path, err := FindProcessPath("tcp", local.IP, local.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, _ := os.Executable()
+	if path != exe {
+		t.Errorf("got %s, want %s", path, exe)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package process
+
+import "net"
+
+func findProcessPath(network string, srcIP net.IP, srcPort int) (string, error) {
+	return "", ErrNotSupported
+}
@@ -11,17 +11,17 @@ func TestDotResolver_Resolv(t *testing.T) {
 		t.Fatal(err)
 	}
 	domain := "www.baidu.com"
-	ip, err := rl.Resolv(context.Background(), domain)
+	ips, err := rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 	domain = "123.242.123.1"
-	ip, err = rl.Resolv(context.Background(), domain)
+	ips, err = rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 
 }
 
@@ -31,17 +31,17 @@ func TestDNSResolver_Resolv(t *testing.T) {
 		t.Fatal(err)
 	}
 	domain := "www.baidu.com"
-	ip, err := rl.Resolv(context.Background(), domain)
+	ips, err := rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 	domain = "123.242.123.1"
-	ip, err = rl.Resolv(context.Background(), domain)
+	ips, err = rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 
 }
 
@@ -51,16 +51,16 @@ func TestLocalResolver_Resolv(t *testing.T) {
 		t.Fatal(err)
 	}
 	domain := "www.baidu.com"
-	ip, err := rl.Resolv(context.Background(), domain)
+	ips, err := rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 	domain = "123.242.123.1"
-	ip, err = rl.Resolv(context.Background(), domain)
+	ips, err = rl.Resolv(context.Background(), domain)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("lookup %s -> %s", domain, ip.String())
+	t.Logf("lookup %s -> %s", domain, ips)
 
 }
@@ -9,7 +9,50 @@ import (
 )
 
 type Resolver interface {
-	Resolv(ctx context.Context, domain string) (net.IP, error)
+	// Resolv returns all addresses of domain
+	Resolv(ctx context.Context, domain string) ([]net.IP, error)
+}
+
+type IPPreference string
+
+const (
+	// IPv4 addresses first
+	IPPreference_IPv4 IPPreference = "ipv4"
+	// IPv6 addresses first
+	IPPreference_IPv6     IPPreference = "ipv6"
+	IPPreference_IPv4Only IPPreference = "ipv4-only"
+	IPPreference_IPv6Only IPPreference = "ipv6-only"
+)
+
+func (p IPPreference) Valid() bool {
+	switch p {
+	case "", IPPreference_IPv4, IPPreference_IPv6, IPPreference_IPv4Only, IPPreference_IPv6Only:
+		return true
+	}
+	return false
+}
+
+// Sort returns ips ordered or filtered by the preference, the order of
+// addresses of the same family is kept. Empty preference is IPv4 first.
+func (p IPPreference) Sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch p {
+	case IPPreference_IPv6:
+		return append(v6, v4...)
+	case IPPreference_IPv4Only:
+		return v4
+	case IPPreference_IPv6Only:
+		return v6
+	default:
+		return append(v4, v6...)
+	}
 }
 
 type resolver struct {
@@ -17,7 +60,7 @@ type resolver struct {
 	Server string
 }
 
-func (r *resolver) Resolv(ctx context.Context, domain string) (net.IP, error) {
+func (r *resolver) Resolv(ctx context.Context, domain string) ([]net.IP, error) {
 	ips, err := r.Resolver.LookupIP(ctx, "ip", domain)
 	if err != nil {
 		return nil, err
@@ -25,12 +68,7 @@ func (r *resolver) Resolv(ctx context.Context, domain string) (net.IP, error) {
 	if len(ips) == 0 {
 		return nil, &net.DNSError{Err: "no ip address", Server: r.Server, Name: domain}
 	}
-	for _, ip := range ips {
-		if ip = ip.To4(); ip != nil {
-			return ip, nil
-		}
-	}
-	return ips[0], err
+	return ips, nil
 }
 
 func NewDoTResolver(server string) (*resolver, error) {
@@ -0,0 +1,22 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIPPreference_Sort(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("1.1.1.1"), net.ParseIP("2001:db8::2"), net.ParseIP("1.0.0.1")}
+	cases := map[IPPreference]string{
+		"":                    "[1.1.1.1 1.0.0.1 2001:db8::1 2001:db8::2]",
+		IPPreference_IPv6:     "[2001:db8::1 2001:db8::2 1.1.1.1 1.0.0.1]",
+		IPPreference_IPv4Only: "[1.1.1.1 1.0.0.1]",
+		IPPreference_IPv6Only: "[2001:db8::1 2001:db8::2]",
+	}
+	for p, want := range cases {
+		if got := fmt.Sprint(p.Sort(ips)); got != want {
+			t.Errorf("%q got %s, want %s", p, got, want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package transform
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -34,7 +35,14 @@ type PackConn struct {
 }
 
 func DialPackConn(name, addr string, tlsConfig *tls.Config) (*PackConn, error) {
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	return DialPackConnContext(context.Background(), name, addr, tlsConfig)
+}
+
+// DialPackConnContext is like DialPackConn, the tls handshake is aborted
+// once ctx is done.
+func DialPackConnContext(ctx context.Context, name, addr string, tlsConfig *tls.Config) (*PackConn, error) {
+	d := tls.Dialer{Config: tlsConfig}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing %s: %v", addr, err)
 	}